@@ -0,0 +1,177 @@
+// Command omogenjudge-fixture fills a SQLite database of the queue and judgehost with a problem and submissions to it,
+// for developing the judge without the frontend and its Postgres database.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/google/logger"
+	"github.com/jsannemo/omogenhost/storage"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	dbPath        = flag.String("db", "", "The SQLite database to fill, as in the sqlite setting of the [database] section.")
+	problemDir    = flag.String("problem", "", "A problem package whose test data is installed as a new problem.")
+	timeLimitMs   = flag.Int64("time_limit_ms", 1000, "The time limit of the installed problem.")
+	memoryLimitKb = flag.Int64("memory_limit_kb", 1024*1024, "The memory limit of the installed problem.")
+	outputLimitKb = flag.Int64("output_limit_kb", 8000, "The output limit of the installed problem.")
+	rejectSamples = flag.Bool("reject_on_sample_failure", false, "Whether runs of the installed problem that fail the samples are rejected without being judged on the other test data.")
+	versionId     = flag.Int64("problem_version", 0, "The problem version to submit to, if no problem is installed.")
+	language      = flag.String("language", "cpp", "The language of the submitted files.")
+)
+
+// storeFile stores the contents of a file, returning its hash.
+func storeFile(store *storage.GormStore, path string) (string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(contents)
+	fileHash := base64.URLEncoding.EncodeToString(hash[:])
+	if err := store.AddStoredFile(storage.StoredFile{FileHash: fileHash, FileContents: contents}); err != nil {
+		return "", fmt.Errorf("failed storing %s: %v", path, err)
+	}
+	return fileHash, nil
+}
+
+// addGroups adds the test group in dir and its subgroups to groups, in the way the frontend installs them: groups are
+// named by their path from the root, and test cases by the name of their .in and .ans files.
+func addGroups(store *storage.GormStore, dir string, name string, parent *storage.ProblemTestgroup, groups []*storage.ProblemTestgroup) ([]*storage.ProblemTestgroup, error) {
+	group := &storage.ProblemTestgroup{
+		Parent:        parent,
+		TestgroupName: name,
+		IsSample:      name == "data/sample",
+		ScoringMode:   storage.ScoringModeSum,
+		VerdictMode:   storage.VerdictModeWorstError,
+	}
+	groups = append(groups, group)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if entry.IsDir() {
+			if groups, err = addGroups(store, path, name+"/"+entry.Name(), group, groups); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !strings.HasSuffix(entry.Name(), ".in") {
+			continue
+		}
+		caseName := strings.TrimSuffix(entry.Name(), ".in")
+		inputHash, err := storeFile(store, path)
+		if err != nil {
+			return nil, err
+		}
+		answerHash, err := storeFile(store, filepath.Join(dir, caseName+".ans"))
+		if err != nil {
+			return nil, err
+		}
+		group.ProblemTestcases = append(group.ProblemTestcases, storage.ProblemTestcase{
+			TestcaseName:   caseName,
+			InputFileHash:  inputHash,
+			OutputFileHash: answerHash,
+		})
+	}
+	return groups, nil
+}
+
+// installProblem installs the test data of a problem package, returning the ID of the new problem version.
+// Output validators, graders and test data settings are not supported, so the problem is judged as a pass-fail problem
+// with the default output validator.
+func installProblem(store *storage.GormStore, dir string) (int64, error) {
+	for _, unsupported := range []string{"output_validators", "graders"} {
+		if _, err := os.Stat(filepath.Join(dir, unsupported)); err == nil {
+			logger.Warningf("Ignoring the %s of the problem", unsupported)
+		}
+	}
+	groups, err := addGroups(store, filepath.Join(dir, "data"), "data", nil, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed reading test data: %v", err)
+	}
+	version := &storage.ProblemVersion{
+		TimeLimitMs:   *timeLimitMs,
+		MemoryLimitKb: *memoryLimitKb,
+		OutputLimitKb: *outputLimitKb,
+		IncludedFiles: storage.JSON("{}"),
+		// Only takes effect on judgehosts that prejudge samples.
+		RejectOnSampleFailure: *rejectSamples,
+	}
+	if err := store.AddProblemVersion(version, groups); err != nil {
+		return 0, fmt.Errorf("failed installing problem: %v", err)
+	}
+	return version.ProblemVersionId, nil
+}
+
+// submit adds a submission of the given files and queues a run of it.
+func submit(store *storage.GormStore, problemVersionId int64, paths []string) (int64, error) {
+	files := make(map[string][]byte)
+	for _, path := range paths {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return 0, err
+		}
+		files[filepath.Base(path)] = contents
+	}
+	// The files are encoded like the frontend does, with their contents in base64.
+	submissionFiles, err := json.Marshal(struct{ Files map[string][]byte }{files})
+	if err != nil {
+		return 0, err
+	}
+	submission := &storage.Submission{
+		Language:        *language,
+		SubmissionFiles: storage.JSON(submissionFiles),
+	}
+	run, err := store.AddSubmission(submission, problemVersionId)
+	if err != nil {
+		return 0, fmt.Errorf("failed adding submission: %v", err)
+	}
+	return run.SubmissionRunId, nil
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s -db judge.db [-problem dir | -problem_version id] [files to submit...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	defer logger.Init("omogenjudge-fixture", true, false, ioutil.Discard).Close()
+	if *dbPath == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	store, err := storage.NewGormStore(storage.Config{Sqlite: *dbPath})
+	if err != nil {
+		logger.Fatalf("Failed opening database: %v", err)
+	}
+
+	problemVersionId := *versionId
+	if *problemDir != "" {
+		if problemVersionId, err = installProblem(store, *problemDir); err != nil {
+			logger.Fatal(err)
+		}
+		logger.Infof("Installed problem version %d", problemVersionId)
+	}
+	if flag.NArg() == 0 {
+		return
+	}
+	if problemVersionId == 0 {
+		logger.Fatal("Either -problem or -problem_version is needed to submit")
+	}
+	runId, err := submit(store, problemVersionId, flag.Args())
+	if err != nil {
+		logger.Fatal(err)
+	}
+	logger.Infof("Queued run %d", runId)
+}
@@ -7,7 +7,11 @@ require (
 	github.com/google/logger v1.1.1
 	github.com/improbable-eng/grpc-web v0.14.1-0.20210710193640-53e1aaa6172d
 	github.com/lib/pq v1.10.2
+	github.com/mattn/go-sqlite3 v1.14.6 // indirect
+	golang.org/x/sys v0.0.0-20210426230700-d19ff857e887
 	google.golang.org/grpc v1.39.0
+	google.golang.org/protobuf v1.25.0
 	gorm.io/driver/postgres v1.1.0
+	gorm.io/driver/sqlite v1.1.4
 	gorm.io/gorm v1.21.12
 )
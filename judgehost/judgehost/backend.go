@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/logger"
+	apipb "github.com/jsannemo/omogenexec/api"
+	"github.com/jsannemo/omogenexec/eval"
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/encoding/protojson"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// evalBackend compiles and evaluates programs.
+type evalBackend interface {
+	// Compile compiles a program on the CPUs of the slot. It is killed if the context is done.
+	Compile(ctx context.Context, slot *evalSlot, program *apipb.Program, outputBase string) (*eval.CompileResult, error)
+	// Evaluate evaluates a plan on the CPUs of the slot, sending the results on the channel and closing it when done.
+	// It is killed if the context is done, but returns only once the evaluation has stopped.
+	Evaluate(ctx context.Context, slot *evalSlot, root string, plan *apipb.EvaluationPlan, results chan<- *apipb.Result) error
+}
+
+// workerBackend compiles and evaluates programs in worker processes running the omogenexec sandbox.
+// The evaluator can't be interrupted, so it runs in a process of its own that can be killed together with the
+// programs it started.
+type workerBackend struct{}
+
+func (workerBackend) Compile(ctx context.Context, slot *evalSlot, program *apipb.Program, outputBase string) (*eval.CompileResult, error) {
+	encodedProgram, err := protojson.Marshal(program)
+	if err != nil {
+		return nil, fmt.Errorf("failed encoding program: %v", err)
+	}
+	var compile *eval.CompileResult
+	request := &workerRequest{Slot: slot.id, Sandbox: slot.sandbox, Cpus: slot.cpus, Program: encodedProgram, OutputBase: outputBase}
+	err = runInWorker(ctx, request, func(message *workerMessage) error {
+		if message.Compile == nil {
+			return nil
+		}
+		compile = &eval.CompileResult{CompilerErrors: message.Compile.CompilerErrors}
+		if message.Compile.Program != nil {
+			compile.Program = &apipb.CompiledProgram{}
+			return protojson.Unmarshal(message.Compile.Program, compile.Program)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if compile == nil {
+		return nil, fmt.Errorf("compilation worker reported no result")
+	}
+	return compile, nil
+}
+
+func (workerBackend) Evaluate(ctx context.Context, slot *evalSlot, root string, plan *apipb.EvaluationPlan, results chan<- *apipb.Result) error {
+	defer close(results)
+	encodedPlan, err := protojson.Marshal(plan)
+	if err != nil {
+		return fmt.Errorf("failed encoding evaluation plan: %v", err)
+	}
+	request := &workerRequest{Slot: slot.id, Sandbox: slot.sandbox, Cpus: slot.cpus, Plan: encodedPlan, Root: root}
+	return runInWorker(ctx, request, func(message *workerMessage) error {
+		if message.Result == nil {
+			return nil
+		}
+		result := &apipb.Result{}
+		if err := protojson.Unmarshal(message.Result, result); err != nil {
+			return err
+		}
+		results <- result
+		return nil
+	})
+}
+
+// backend is used for all compilation and evaluation. Tests replace it with a fake that replays scripted results.
+var backend evalBackend = workerBackend{}
+
+// workerArg makes the judgehost binary run as a worker process.
+const workerArg = "-worker"
+
+// workerRequest is what a worker process is asked to do: compile Program, or evaluate Plan.
+// It is sent as JSON on the standard input of the worker. The protocol buffers in it are encoded with protojson,
+// since encoding/json doesn't know about oneofs and well-known types.
+type workerRequest struct {
+	// Slot is the slot the worker runs in, and Cpus the CPUs that the worker and everything it starts are pinned to.
+	Slot int
+	// Sandbox is the id of the sandbox the worker runs programs in.
+	Sandbox    int
+	Cpus       []int
+	Program    json.RawMessage `json:",omitempty"`
+	OutputBase string          `json:",omitempty"`
+	Plan       json.RawMessage `json:",omitempty"`
+	Root       string          `json:",omitempty"`
+}
+
+// workerMessage is a line of JSON that a worker process writes to its results file.
+type workerMessage struct {
+	Compile *workerCompileResult `json:",omitempty"`
+	Result  json.RawMessage      `json:",omitempty"`
+	Error   string               `json:",omitempty"`
+}
+
+// workerCompileResult is an eval.CompileResult with its program encoded with protojson.
+type workerCompileResult struct {
+	Program        json.RawMessage `json:",omitempty"`
+	CompilerErrors string          `json:",omitempty"`
+}
+
+// runInWorker starts a worker process for the request, passing its messages to handle until it exits.
+// A message that handle fails on stops the worker. If the context is done, the worker is killed together with the
+// processes it started, and the error of the context is returned once it has exited.
+func runInWorker(ctx context.Context, request *workerRequest, handle func(*workerMessage) error) error {
+	input, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed encoding worker request: %v", err)
+	}
+	output, outputWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed creating worker pipe: %v", err)
+	}
+	defer output.Close()
+	cmd := exec.Command("/proc/self/exe", workerArg)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{outputWriter}
+	// The worker gets a process group of its own, so that the processes it starts can be killed with it.
+	// It is also killed if the judgehost dies.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Pdeathsig: syscall.SIGKILL}
+	err = cmd.Start()
+	outputWriter.Close()
+	if err != nil {
+		return fmt.Errorf("failed starting worker: %v", err)
+	}
+	kill := func() {
+		if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			logger.Warningf("failed killing worker %d: %v", cmd.Process.Pid, err)
+		}
+	}
+	exited := make(chan struct{})
+	killerDone := make(chan struct{})
+	go func() {
+		defer close(killerDone)
+		select {
+		case <-ctx.Done():
+			kill()
+		case <-exited:
+		}
+	}()
+
+	var workerErr error
+	decoder := json.NewDecoder(output)
+	for {
+		var message workerMessage
+		if err := decoder.Decode(&message); err != nil {
+			if err != io.EOF {
+				workerErr = fmt.Errorf("failed reading worker results: %v", err)
+				// A worker that can't be understood is stopped, so that it doesn't block on writing its results.
+				kill()
+			}
+			break
+		}
+		if message.Error != "" {
+			workerErr = errors.New(message.Error)
+			continue
+		}
+		if err := handle(&message); err != nil {
+			workerErr = fmt.Errorf("failed reading worker results: %v", err)
+			kill()
+			break
+		}
+	}
+	waitErr := cmd.Wait()
+	close(exited)
+	<-killerDone
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if workerErr != nil {
+		return workerErr
+	}
+	if waitErr != nil {
+		return fmt.Errorf("worker failed: %v", waitErr)
+	}
+	return nil
+}
+
+// runWorker is the main function of a worker process. It performs the request on the standard input, writing its
+// results to file descriptor 3.
+func runWorker() {
+	output := os.NewFile(3, "results")
+	// The programs the evaluator starts must not keep the results open after the worker exits.
+	syscall.CloseOnExec(3)
+	encoder := json.NewEncoder(output)
+	send := func(message *workerMessage) {
+		if err := encoder.Encode(message); err != nil {
+			logger.Fatalf("failed writing worker results: %v", err)
+		}
+	}
+	var request workerRequest
+	if err := json.NewDecoder(os.Stdin).Decode(&request); err != nil {
+		send(&workerMessage{Error: fmt.Sprintf("failed reading worker request: %v", err)})
+		return
+	}
+	if err := pinProcess(request.Cpus); err != nil {
+		send(&workerMessage{Error: fmt.Sprintf("failed pinning worker of slot %d to CPUs %v: %v", request.Slot, request.Cpus, err)})
+		return
+	}
+	// Workers judging at the same time must not share sandboxes.
+	eval.SetSandboxId(request.Sandbox)
+	if request.Program != nil {
+		program := &apipb.Program{}
+		if err := protojson.Unmarshal(request.Program, program); err != nil {
+			send(&workerMessage{Error: fmt.Sprintf("failed reading program: %v", err)})
+			return
+		}
+		compile, err := eval.Compile(program, request.OutputBase)
+		if err != nil {
+			send(&workerMessage{Error: err.Error()})
+			return
+		}
+		message := &workerCompileResult{CompilerErrors: compile.CompilerErrors}
+		if compile.Program != nil {
+			if message.Program, err = protojson.Marshal(compile.Program); err != nil {
+				send(&workerMessage{Error: fmt.Sprintf("failed encoding compiled program: %v", err)})
+				return
+			}
+		}
+		send(&workerMessage{Compile: message})
+		return
+	}
+	plan := &apipb.EvaluationPlan{}
+	if err := protojson.Unmarshal(request.Plan, plan); err != nil {
+		send(&workerMessage{Error: fmt.Sprintf("failed reading evaluation plan: %v", err)})
+		return
+	}
+	results := make(chan *apipb.Result, 1000)
+	evaluator, err := eval.NewEvaluator(request.Root, plan, results)
+	if err != nil {
+		send(&workerMessage{Error: fmt.Sprintf("failed initializing evaluator: %v", err)})
+		return
+	}
+	evalDone := make(chan error, 1)
+	go func() {
+		evalDone <- evaluator.Evaluate()
+	}()
+	for result := range results {
+		encoded, err := protojson.Marshal(result)
+		if err != nil {
+			// The evaluation still has to finish, so that it doesn't block on sending its results.
+			send(&workerMessage{Error: fmt.Sprintf("failed encoding result: %v", err)})
+			continue
+		}
+		send(&workerMessage{Result: encoded})
+	}
+	if err := <-evalDone; err != nil {
+		send(&workerMessage{Error: fmt.Sprintf("failed evaluation: %v", err)})
+	}
+}
+
+// pinProcess restricts all threads of the process to the given CPUs. Threads and processes started later inherit the
+// restriction, so that everything the evaluation runs is measured without interference from other slots.
+func pinProcess(cpus []int) error {
+	if len(cpus) == 0 {
+		return nil
+	}
+	var set unix.CPUSet
+	for _, cpu := range cpus {
+		set.Set(cpu)
+	}
+	tasks, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		if err := unix.SchedSetaffinity(tid, &set); err != nil && err != unix.ESRCH {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+type activeRun struct {
+	cancel    context.CancelFunc
+	cancelled bool
+}
+
+// runRegistry keeps track of the runs this judgehost is judging so that they can be cancelled.
+type runRegistry struct {
+	mu   sync.Mutex
+	runs map[int64]*activeRun
+}
+
+var activeRuns = &runRegistry{runs: make(map[int64]*activeRun)}
+
+// start registers a run that is about to be judged, returning a context that is cancelled if the run is.
+func (r *runRegistry) start(ctx context.Context, runId int64) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.runs[runId] = &activeRun{cancel: cancel}
+	return ctx
+}
+
+// finish removes a run that is no longer being judged.
+func (r *runRegistry) finish(runId int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if run, found := r.runs[runId]; found {
+		run.cancel()
+		delete(r.runs, runId)
+	}
+}
+
+// cancel interrupts the judging of a run. It returns false if the run is not being judged.
+func (r *runRegistry) cancel(runId int64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	run, found := r.runs[runId]
+	if !found {
+		return false
+	}
+	run.cancelled = true
+	run.cancel()
+	return true
+}
+
+// wasCancelled returns whether the judging of a run was interrupted through cancel.
+func (r *runRegistry) wasCancelled(runId int64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	run, found := r.runs[runId]
+	return found && run.cancelled
+}
@@ -2,18 +2,24 @@ package main
 
 import (
 	"archive/zip"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"github.com/google/logger"
 	apipb "github.com/jsannemo/omogenexec/api"
-	"github.com/jsannemo/omogenexec/eval"
 	"github.com/jsannemo/omogenexec/util"
+	hostpb "github.com/jsannemo/omogenhost/judgehost/api"
 	"github.com/jsannemo/omogenhost/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -34,63 +40,190 @@ type includedCodeJson struct {
 	FilesByLanguage map[string]map[string]string `json:"files_by_language"`
 }
 
-var evalMutex sync.Mutex
+// dataRoot is where the judgehost keeps cached test data and the files of the programs it judges.
+var dataRoot = "/var/lib/omogen"
 
-func toStorageVerdict(verdict apipb.Verdict) storage.Verdict {
+// cacheMutex guards the files cached on disk, which are shared between evaluation slots.
+var cacheMutex sync.Mutex
+
+// progressReporter is told about the progress of an evaluation as it happens.
+type progressReporter func(progress *hostpb.EvaluateProgress)
+
+// judgeError is a failure to judge a run that has been recorded on the run.
+// It is reported in the RPC response rather than as an RPC error, since judging it again would fail the same way.
+type judgeError struct {
+	reason  string
+	message string
+}
+
+func (e *judgeError) Error() string {
+	return fmt.Sprintf("%s: %s", e.reason, e.message)
+}
+
+func toStorageVerdict(verdict apipb.Verdict) (storage.Verdict, error) {
 	switch verdict {
 	case apipb.Verdict_ACCEPTED:
-		return storage.VerdictAccepted
+		return storage.VerdictAccepted, nil
 	case apipb.Verdict_TIME_LIMIT_EXCEEDED:
-		return storage.VerdictTimeLimitExceeded
+		return storage.VerdictTimeLimitExceeded, nil
 	case apipb.Verdict_WRONG_ANSWER:
-		return storage.VerdictWrongAnswer
+		return storage.VerdictWrongAnswer, nil
 	case apipb.Verdict_RUN_TIME_ERROR:
-		return storage.VerdictRuntimeError
+		return storage.VerdictRuntimeError, nil
+	case apipb.Verdict_MEMORY_LIMIT_EXCEEDED:
+		return storage.VerdictMemoryLimitExceeded, nil
+	case apipb.Verdict_OUTPUT_LIMIT_EXCEEDED:
+		return storage.VerdictOutputLimitExceeded, nil
+	case apipb.Verdict_JUDGE_ERROR:
+		return storage.VerdictJudgeError, nil
+	}
+	return storage.VerdictUnjudged, fmt.Errorf("unknown API verdict: %v", verdict)
+}
+
+// leaseRenewInterval is how often leases on runs being judged are renewed.
+var leaseRenewInterval = storage.LeaseRenewInterval
+
+// runLease is a lease on a run that is kept renewed while the run is judged.
+type runLease struct {
+	done chan struct{}
+	lost int32
+}
+
+// keepLease renews the lease on a run until stop is called. If the lease is lost, e.g. because the queue requeued the
+// run after failing to reach the judgehost, lose is called so that the evaluation stops without writing any results.
+func keepLease(store storage.Store, runId int64, leaseOwner string, lose func()) *runLease {
+	lease := &runLease{done: make(chan struct{})}
+	ticker := time.NewTicker(leaseRenewInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-lease.done:
+				return
+			case <-ticker.C:
+				held, err := store.RenewLease(runId, leaseOwner)
+				if err != nil {
+					logger.Warningf("failed renewing lease on run %d: %v", runId, err)
+				} else if !held {
+					logger.Errorf("Lost lease on run %d", runId)
+					atomic.StoreInt32(&lease.lost, 1)
+					lose()
+					return
+				}
+			}
+		}
+	}()
+	return lease
+}
+
+func (l *runLease) stop() {
+	close(l.done)
+}
+
+func (l *runLease) wasLost() bool {
+	return atomic.LoadInt32(&l.lost) == 1
+}
+
+// errLeaseLost is returned when the judgehost no longer holds the lease on the run it judges.
+func errLeaseLost(runId int64) error {
+	return status.Errorf(codes.FailedPrecondition, "lost lease on run %d", runId)
+}
+
+// notifyStatus publishes the current status of the run to listeners of run progress.
+func notifyStatus(store storage.Store, run *storage.SubmissionRun) {
+	progress := storage.RunProgress{
+		RunId:   run.SubmissionRunId,
+		Status:  run.Status,
+		Verdict: run.Verdict,
+	}
+	if err := store.NotifyProgress(progress); err != nil {
+		logger.Warningf("%v", err)
 	}
-	panic(fmt.Sprintf("unknown API verdict: %v", verdict))
 }
 
-func evaluate(runId int64) error {
-	evalMutex.Lock()
-	defer evalMutex.Unlock()
+// markJudgeError records that the run could not be judged, and why.
+func markJudgeError(store storage.Store, run *storage.SubmissionRun, leaseOwner string, reason string, message string) error {
+	run.Status = storage.StatusJudgeError
+	run.Verdict = storage.VerdictJudgeError
+	run.JudgeErrorReason = reason
+	run.JudgeError = message
+	if _, err := store.UpdateRun(run, leaseOwner, "Status", "Verdict", "JudgeErrorReason", "JudgeError"); err != nil {
+		return fmt.Errorf("failed marking run as judging error: %v", err)
+	}
+	notifyStatus(store, run)
+	return nil
+}
 
-	var run storage.SubmissionRun
-	if res := storage.GormDB.Debug().Joins("Submission").Joins("ProblemVersion").Preload("ProblemVersion.OutputValidator").Preload("ProblemVersion.CustomGrader").First(&run, runId); res.Error != nil {
-		return fmt.Errorf("failed loading run: %v", res.Error)
+// failRun marks the run as a judging error and returns the judgeError describing it.
+func failRun(store storage.Store, run *storage.SubmissionRun, leaseOwner string, reason string, message string) error {
+	logger.Errorf("Failed judging run %d (%s): %s", run.SubmissionRunId, reason, message)
+	if err := markJudgeError(store, run, leaseOwner, reason, message); err != nil {
+		return err
 	}
-	logger.Infof("Found run %d of submission %d", run.SubmissionRunId, run.SubmissionId)
+	return &judgeError{reason: reason, message: message}
+}
+
+// markCancelled records that the judging of the run was cancelled.
+func markCancelled(store storage.Store, run *storage.SubmissionRun, leaseOwner string) error {
+	run.Status = storage.StatusCancelled
+	if _, err := store.UpdateRun(run, leaseOwner, "Status"); err != nil {
+		return fmt.Errorf("failed marking run as cancelled: %v", err)
+	}
+	notifyStatus(store, run)
+	return nil
+}
 
-	run.Status = storage.StatusCompiling
-	if res := storage.GormDB.Select("Status").Save(&run); res.Error != nil {
-		logger.Warningf("failed marking run as compiling: %v", res.Error)
+// abortEvaluation handles an evaluation whose context is done, once its compilation or evaluation has stopped.
+// Nothing is written to a run whose lease was lost, since it now belongs to someone else. A run cancelled by request is marked as cancelled, and a run that ran out of time as a judging error.
+// Otherwise the judgehost lost the caller, e.g. because the queue restarted. The run is then left to the queue, which
+// retries it when told that the evaluation was aborted, or requeues it once the lease expires.
+// The files of the run are removed.
+func abortEvaluation(ctx context.Context, store storage.Store, run *storage.SubmissionRun, leaseOwner string, lease *runLease, subRoot string) error {
+	if err := os.RemoveAll(subRoot); err != nil {
+		logger.Warningf("failed cleaning up aborted run %d: %v", run.SubmissionRunId, err)
+	}
+	if lease.wasLost() {
+		return errLeaseLost(run.SubmissionRunId)
+	}
+	if activeRuns.wasCancelled(run.SubmissionRunId) {
+		logger.Infof("Run %d was cancelled", run.SubmissionRunId)
+		if err := markCancelled(store, run, leaseOwner); err != nil {
+			return err
+		}
+		return status.Errorf(codes.Canceled, "run %d was cancelled", run.SubmissionRunId)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		reason := fmt.Sprintf("evaluation aborted: %v", ctx.Err())
+		logger.Warningf("Run %d: %s", run.SubmissionRunId, reason)
+		if err := markJudgeError(store, run, leaseOwner, storage.JudgeErrorAborted, reason); err != nil {
+			return err
+		}
+		return status.Error(codes.DeadlineExceeded, reason)
 	}
-	lang, ok := langMap[run.Submission.Language]
+	logger.Warningf("Run %d: evaluation aborted: %v", run.SubmissionRunId, ctx.Err())
+	return status.Errorf(codes.Aborted, "evaluation of run %d aborted: %v", run.SubmissionRunId, ctx.Err())
+}
+
+// buildProgram collects the source files of a program, adding the files the problem includes for the language.
+func buildProgram(language string, files map[string][]byte, version storage.ProblemVersion) (*apipb.Program, error) {
+	lang, ok := langMap[language]
 	if !ok {
-		return fmt.Errorf("run has unknown language %s", run.Submission.Language)
+		return nil, fmt.Errorf("unknown language %s", language)
 	}
 	program := &apipb.Program{
 		Language: lang,
 	}
-	submissionFiles := submissionJson{}
-	if err := json.Unmarshal(run.Submission.SubmissionFiles, &submissionFiles); err != nil {
-		return err
-	}
 	includedCode := includedCodeJson{}
-	if err := json.Unmarshal(run.ProblemVersion.IncludedFiles, &includedCode); err != nil {
-		return err
+	if err := json.Unmarshal(version.IncludedFiles, &includedCode); err != nil {
+		return nil, err
 	}
-	logger.Infof("Lang: %v, included code:", run.Submission.Language, includedCode)
-	extraFiles := includedCode.FilesByLanguage[run.Submission.Language]
+	logger.Infof("Lang: %v, included code: %v", language, includedCode)
+	extraFiles := includedCode.FilesByLanguage[language]
 
-	logger.Infof("Files: %v", submissionFiles)
-	for path, content := range submissionFiles.Files {
+	for path, content := range files {
 		if _, hasExtraFile := extraFiles[path]; hasExtraFile {
 			continue
 		}
-		content, err := base64.StdEncoding.DecodeString(content)
-		if err != nil {
-			return err
-		}
 		program.Sources = append(program.Sources, &apipb.SourceFile{
 			Path:     filepath.Base(path),
 			Contents: content,
@@ -104,137 +237,403 @@ func evaluate(runId int64) error {
 			Contents: []byte(content),
 		})
 	}
+	return program, nil
+}
 
+func evaluate(ctx context.Context, store storage.Store, runId int64, leaseOwner string, report progressReporter) error {
+	ctx = activeRuns.start(ctx, runId)
+	defer activeRuns.finish(runId)
+	slot, err := acquireSlot(ctx)
+	if err != nil {
+		return err
+	}
+	defer slot.release()
+
+	claimed, err := store.ClaimRun(runId, leaseOwner)
+	if err != nil {
+		return fmt.Errorf("failed claiming run: %v", err)
+	}
+	if !claimed {
+		return status.Errorf(codes.FailedPrecondition, "run %d is not queued", runId)
+	}
+	// An aborted evaluation keeps its lease, so that the run is requeued once it expires even if nobody retries it.
+	keepLeased := false
+	defer func() {
+		if keepLeased {
+			return
+		}
+		if err := store.ReleaseLease(runId, leaseOwner); err != nil {
+			logger.Warningf("failed releasing lease on run %d: %v", runId, err)
+		}
+	}()
+	ctx, cancelEvaluation := context.WithCancel(ctx)
+	defer cancelEvaluation()
+	lease := keepLease(store, runId, leaseOwner, cancelEvaluation)
+	defer lease.stop()
+
+	loadedRun, err := store.LoadRun(runId)
+	if err != nil {
+		return fmt.Errorf("failed loading run: %v", err)
+	}
+	run := *loadedRun
+	logger.Infof("Found run %d of submission %d", run.SubmissionRunId, run.SubmissionId)
+	notifyStatus(store, &run)
 	// In case we retry judging of the run, put it in a new folder instead to avoid collisions
-	subRoot := fmt.Sprintf("/var/lib/omogen/submissions/%d-%d", runId, time.Now().Unix())
-	compile, err := eval.Compile(program, filepath.Join(subRoot, "compile"))
+	subRoot := filepath.Join(dataRoot, "submissions", fmt.Sprintf("%d-%d", runId, time.Now().Unix()))
+	abort := func() error {
+		err := abortEvaluation(ctx, store, &run, leaseOwner, lease, subRoot)
+		keepLeased = status.Code(err) == codes.Aborted
+		return err
+	}
+	if ctx.Err() != nil {
+		return abort()
+	}
+
+	submissionFiles := submissionJson{}
+	if err := json.Unmarshal(run.Submission.SubmissionFiles, &submissionFiles); err != nil {
+		return err
+	}
+	logger.Infof("Files: %v", submissionFiles)
+	files := make(map[string][]byte)
+	for path, content := range submissionFiles.Files {
+		content, err := base64.StdEncoding.DecodeString(content)
+		if err != nil {
+			return err
+		}
+		files[path] = content
+	}
+	program, err := buildProgram(run.Submission.Language, files, run.ProblemVersion)
 	if err != nil {
 		return err
 	}
+
+	compile, err := backend.Compile(ctx, slot, program, filepath.Join(subRoot, "compile"))
+	if ctx.Err() != nil {
+		return abort()
+	}
+	if err != nil {
+		return err
+	}
+	report(&hostpb.EvaluateProgress{
+		Progress: &hostpb.EvaluateProgress_CompileFinished{
+			CompileFinished: &hostpb.CompileFinished{
+				CompileError: compile.CompilerErrors,
+				Success:      compile.Program != nil,
+			},
+		},
+	})
 	if compile.Program == nil {
 		run.CompileError = compile.CompilerErrors
 		run.Status = storage.StatusCompileError
-		if res := storage.GormDB.Select("CompileError", "Status").Save(&run); res.Error != nil {
-			return fmt.Errorf("failed marking program as compile error: %v", res.Error)
+		held, err := store.UpdateRun(&run, leaseOwner, "CompileError", "Status")
+		if err != nil {
+			return fmt.Errorf("failed marking program as compile error: %v", err)
 		}
+		if !held {
+			return errLeaseLost(runId)
+		}
+		notifyStatus(store, &run)
 		return nil
 	} else {
 		run.Status = storage.StatusRunning
-		if res := storage.GormDB.Select("Status").Save(&run); res.Error != nil {
-			return fmt.Errorf("failed marking program as running: %v", res.Error)
+		held, err := store.UpdateRun(&run, leaseOwner, "Status")
+		if err != nil {
+			return fmt.Errorf("failed marking program as running: %v", err)
+		}
+		if !held {
+			return errLeaseLost(runId)
 		}
+		notifyStatus(store, &run)
 	}
 	logger.Infof("Compiled program runs with: %v", compile.Program.RunCommand)
 
-	var groups []*storage.ProblemTestgroup
-	if res := storage.GormDB.Debug().Where("problem_version_id = ?", run.ProblemVersionId).Preload("ProblemTestcases").Order("problem_testgroup_id asc").Find(&groups); res.Error != nil {
-		return fmt.Errorf("failed gathering testdata: %v", res.Error)
-	}
-	subgroupMap := make(map[int64][]*storage.ProblemTestgroup)
-	for _, group := range groups {
-		if group.ProblemTestgroupId == run.ProblemVersion.RootGroupId {
-			run.ProblemVersion.RootGroup = group
-		}
-		if group.ParentId != 0 {
-			subgroupMap[group.ParentId] = append(subgroupMap[group.ParentId], group)
-		}
+	groups, err := store.LoadTestgroups(run.ProblemVersionId)
+	if err != nil {
+		return fmt.Errorf("failed gathering testdata: %v", err)
 	}
 
-	evalPlan, err := makeEvalPlan(compile.Program, run.ProblemVersion)
+	cacheMutex.Lock()
+	evalPlan, source, err := makeEvalPlan(store, compile.Program, run.ProblemVersion, groups)
+	cacheMutex.Unlock()
 	if err != nil {
 		return fmt.Errorf("failed constructing evaluation plan: %v", err)
 	}
-	resultChan := make(chan *apipb.Result, 1000)
-	var lastRes *apipb.Result
-	resultWait := sync.WaitGroup{}
-	resultWait.Add(1)
-	var resultError error
-	go func() {
-		var groupStack []*storage.ProblemTestgroup
-		var tcIdx []int
-		var groupIdx []int
-		groupStack = append(groupStack, run.ProblemVersion.RootGroup)
-		tcIdx = append(tcIdx, 0)
-		groupIdx = append(groupIdx, 0)
-
-		for result := range resultChan {
-			for {
-				curIdx := len(groupStack) - 1
-				curGroup := groupStack[curIdx]
-				subgroups, found := subgroupMap[curGroup.ProblemTestgroupId]
-				if !found {
-					break
-				}
-				nextTc := tcIdx[curIdx]
-				nextGroup := groupIdx[curIdx]
-				// If the next item to be judged is a test case group, transcend down to that group
-				if nextGroup < len(subgroups) && (nextTc == len(curGroup.ProblemTestcases) ||
-					subgroups[nextGroup].TestgroupName < curGroup.ProblemTestcases[nextTc].TestcaseName) {
-					groupIdx[curIdx] = nextGroup + 1
-					groupStack = append(groupStack, subgroups[nextGroup])
-					tcIdx = append(tcIdx, 0)
-					groupIdx = append(groupIdx, 0)
-				} else {
-					break
-				}
+	walker := newPlanWalker(evalPlan, source)
+	if ctx.Err() != nil {
+		return abort()
+	}
+	if prejudgeSamples {
+		rejected, err := prejudgeRun(ctx, store, slot, &run, leaseOwner, subRoot, evalPlan, groups)
+		if ctx.Err() != nil {
+			return abort()
+		}
+		if err != nil {
+			return err
+		}
+		if rejected {
+			logger.Infof("Run %d was rejected on the samples", run.SubmissionRunId)
+			return nil
+		}
+	}
+	var rootRes *apipb.Result
+	// Results are tagged with the judging attempt that wrote them, so that the run only keeps those of the attempt that
+	// finished it.
+	attemptId := fmt.Sprintf("%s/%d", leaseOwner, time.Now().UnixNano())
+	writer := newResultWriter(store, run.SubmissionRunId, leaseOwner, attemptId)
+	defer writer.abort()
+	var verdictError error
+	var mappingError error
+	judgedCases := 0
+	handleResult := func(result *apipb.Result) {
+		// Results of an aborted evaluation are thrown away, since the run is marked as failed once the evaluation stops.
+		// Once a result could not be attributed, the following ones can't be trusted either.
+		if ctx.Err() != nil || mappingError != nil {
+			return
+		}
+		verdict, err := toStorageVerdict(result.Verdict)
+		if err != nil && verdictError == nil {
+			verdictError = err
+		}
+		switch result.Type {
+		case apipb.ResultType_TEST_CASE:
+			testcase, err := walker.nextCase()
+			if err != nil {
+				mappingError = err
+				return
 			}
-
-			curIdx := len(groupStack) - 1
-			curGroup := groupStack[curIdx]
-			switch result.Type {
-			case apipb.ResultType_TEST_CASE:
-				testcase := curGroup.ProblemTestcases[tcIdx[curIdx]]
-				tcRun := storage.SubmissionCaseRun{
-					SubmissionRunId:   run.SubmissionRunId,
-					ProblemTestcaseId: testcase.ProblemTestcaseId,
-					TimeUsageMs:       result.TimeUsageMs,
-					Score:             result.Score,
-					Verdict:           toStorageVerdict(result.Verdict),
-				}
-				if res := storage.GormDB.Save(&tcRun); res.Error != nil {
-					resultError = res.Error
-				}
-				tcIdx[curIdx] += 1
-			case apipb.ResultType_TEST_GROUP:
-				tcRun := storage.SubmissionGroupRun{
-					SubmissionRunId:    run.SubmissionRunId,
-					ProblemTestgroupId: curGroup.ProblemTestgroupId,
-					TimeUsageMs:        result.TimeUsageMs,
-					Score:              result.Score,
-					Verdict:            toStorageVerdict(result.Verdict),
-				}
-				if res := storage.GormDB.Save(&tcRun); res.Error != nil {
-					resultError = res.Error
-				}
-				groupStack = groupStack[:curIdx]
-				tcIdx = tcIdx[:curIdx]
-				groupIdx = groupIdx[:curIdx]
+			tcRun := storage.SubmissionCaseRun{
+				SubmissionRunId:   run.SubmissionRunId,
+				ProblemTestcaseId: testcase.ProblemTestcaseId,
+				TimeUsageMs:       result.TimeUsageMs,
+				Score:             result.Score,
+				Verdict:           verdict,
+				AttemptId:         attemptId,
+				Feedback:          collectCaseFeedback(result, verdict, testcase),
+			}
+			caseIndex := judgedCases
+			judgedCases++
+			writer.addCase(tcRun, storage.RunProgress{
+				RunId:             run.SubmissionRunId,
+				Status:            run.Status,
+				TestcaseIndex:     &caseIndex,
+				ProblemTestcaseId: tcRun.ProblemTestcaseId,
+				Verdict:           tcRun.Verdict,
+			})
+			report(&hostpb.EvaluateProgress{
+				Progress: &hostpb.EvaluateProgress_TestCaseFinished{
+					TestCaseFinished: &hostpb.TestCaseFinished{
+						ProblemTestcaseId: tcRun.ProblemTestcaseId,
+						Verdict:           string(tcRun.Verdict),
+						TimeUsageMs:       tcRun.TimeUsageMs,
+						Score:             tcRun.Score,
+					},
+				},
+			})
+		case apipb.ResultType_TEST_GROUP:
+			group, err := walker.nextGroup()
+			if err != nil {
+				mappingError = err
+				return
+			}
+			tcRun := storage.SubmissionGroupRun{
+				SubmissionRunId:    run.SubmissionRunId,
+				ProblemTestgroupId: group.ProblemTestgroupId,
+				TimeUsageMs:        result.TimeUsageMs,
+				Score:              result.Score,
+				Verdict:            verdict,
+				AttemptId:          attemptId,
+			}
+			writer.addGroup(tcRun)
+			report(&hostpb.EvaluateProgress{
+				Progress: &hostpb.EvaluateProgress_TestGroupFinished{
+					TestGroupFinished: &hostpb.TestGroupFinished{
+						ProblemTestgroupId: tcRun.ProblemTestgroupId,
+						Verdict:            string(tcRun.Verdict),
+						TimeUsageMs:        tcRun.TimeUsageMs,
+						Score:              tcRun.Score,
+					},
+				},
+			})
+			if group.ProblemTestgroupId == run.ProblemVersion.RootGroupId {
+				rootRes = result
 			}
-			lastRes = result
 		}
-		resultWait.Done()
-	}()
-	evaluator, err := eval.NewEvaluator(subRoot, evalPlan, resultChan)
+	}
+	// The result handler above relies on results arriving in plan order, which judgePlan keeps even if it judges the
+	// test cases in parallel.
+	err = slot.judgePlan(ctx, subRoot, evalPlan, handleResult)
+	if ctx.Err() != nil {
+		return abort()
+	}
+	if status.Code(err) == codes.Aborted {
+		// Judging in parallel failed, which the queue retries like an aborted evaluation.
+		logger.Warningf("Run %d: %v", run.SubmissionRunId, err)
+		keepLeased = true
+		return err
+	}
 	if err != nil {
-		return fmt.Errorf("failed initializing evaluator: %v", err)
+		return failRun(store, &run, leaseOwner, storage.JudgeErrorEvaluator, err.Error())
+	}
+	if verdictError != nil {
+		return failRun(store, &run, leaseOwner, storage.JudgeErrorUnknownVerdict, verdictError.Error())
 	}
-	if err := evaluator.Evaluate(); err != nil {
-		return fmt.Errorf("failed evaluation: %v", err)
+	if mappingError != nil {
+		return failRun(store, &run, leaseOwner, storage.JudgeErrorEvaluator, mappingError.Error())
+	}
+	if rootRes == nil {
+		return failRun(store, &run, leaseOwner, storage.JudgeErrorEvaluator, "evaluator reported no result for the root group")
+	}
+	verdict, err := toStorageVerdict(rootRes.Verdict)
+	if err != nil {
+		return failRun(store, &run, leaseOwner, storage.JudgeErrorUnknownVerdict, err.Error())
 	}
-	resultWait.Wait()
-	if resultError != nil {
-		return fmt.Errorf("failed writing sub-submission results: %v", err)
+	if verdict == storage.VerdictJudgeError {
+		return failRun(store, &run, leaseOwner, storage.JudgeErrorEvaluator, "evaluator failed judging the root group")
 	}
-	run.Status = storage.StatusDone
-	run.TimeUsageMs = lastRes.TimeUsageMs
-	run.Score = lastRes.Score
-	run.Verdict = toStorageVerdict(lastRes.Verdict)
-	if res := storage.GormDB.Select("Status", "Verdict", "TimeUsageMs", "Score").Save(&run); res.Error != nil {
-		return fmt.Errorf("failed writing submission results: %v", res.Error)
+	run.TimeUsageMs = rootRes.TimeUsageMs
+	run.Score = rootRes.Score
+	run.Verdict = verdict
+	if err := writer.finish(&run); err != nil {
+		return fmt.Errorf("failed writing submission results: %v", err)
 	}
+	notifyStatus(store, &run)
 	return nil
 }
 
+// planOrder orders the test cases and subgroups of a group in an evaluation plan by name. Runs of digits are compared
+// as numbers, so that e.g. test case 9 comes before test case 10.
+func planOrder(a, b string) bool {
+	restA, restB := a, b
+	for restA != "" && restB != "" {
+		var chunkA, chunkB string
+		chunkA, restA = nameChunk(restA)
+		chunkB, restB = nameChunk(restB)
+		if chunkA == chunkB {
+			continue
+		}
+		if !isDigit(chunkA[0]) || !isDigit(chunkB[0]) {
+			return chunkA < chunkB
+		}
+		numA, numB := strings.TrimLeft(chunkA, "0"), strings.TrimLeft(chunkB, "0")
+		if len(numA) != len(numB) {
+			return len(numA) < len(numB)
+		}
+		if numA != numB {
+			return numA < numB
+		}
+	}
+	if restA != "" || restB != "" {
+		return restA == ""
+	}
+	// Names that only differ in leading zeroes are still ordered.
+	return a < b
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// nameChunk splits off the leading run of digits or non-digits of a name.
+func nameChunk(name string) (string, string) {
+	end := 1
+	for end < len(name) && isDigit(name[end]) == isDigit(name[0]) {
+		end++
+	}
+	return name[:end], name[end:]
+}
+
+// judgedItem is a test case or a subgroup of a group.
+type judgedItem struct {
+	testcase *apipb.TestCase
+	group    *apipb.TestGroup
+}
+
+// judgingOrder returns the test cases and subgroups of a group in the order the evaluator judges them. The plan lists
+// both in planOrder, and the evaluator judges them as one list in that order.
+func judgingOrder(group *apipb.TestGroup) []judgedItem {
+	var items []judgedItem
+	tcIdx, groupIdx := 0, 0
+	for tcIdx < len(group.Cases) || groupIdx < len(group.Groups) {
+		if groupIdx < len(group.Groups) && (tcIdx == len(group.Cases) || planOrder(group.Groups[groupIdx].Name, group.Cases[tcIdx].Name)) {
+			items = append(items, judgedItem{group: group.Groups[groupIdx]})
+			groupIdx++
+		} else {
+			items = append(items, judgedItem{testcase: group.Cases[tcIdx]})
+			tcIdx++
+		}
+	}
+	return items
+}
+
+// planSource maps the test cases and groups of an evaluation plan to the test data they were made from.
+type planSource struct {
+	cases  map[*apipb.TestCase]storage.ProblemTestcase
+	groups map[*apipb.TestGroup]*storage.ProblemTestgroup
+}
+
+// planWalker attributes the results of an evaluation to the test cases and groups of the plan.
+// Results carry no identifiers, so this follows the plan in judgingOrder, where the result of a group follows the
+// results of its contents.
+type planWalker struct {
+	source planSource
+	stack  []walkedGroup
+}
+
+// walkedGroup is a group of the plan whose results are being attributed.
+type walkedGroup struct {
+	group *apipb.TestGroup
+	items []judgedItem
+	next  int
+}
+
+func newPlanWalker(plan *apipb.EvaluationPlan, source planSource) *planWalker {
+	w := &planWalker{source: source}
+	w.push(plan.RootGroup)
+	return w
+}
+
+func (w *planWalker) push(group *apipb.TestGroup) {
+	w.stack = append(w.stack, walkedGroup{group: group, items: judgingOrder(group)})
+}
+
+// descend moves into the subgroups that are judged before the next test case of the current group.
+func (w *planWalker) descend() {
+	for len(w.stack) > 0 {
+		cur := &w.stack[len(w.stack)-1]
+		if cur.next == len(cur.items) || cur.items[cur.next].group == nil {
+			break
+		}
+		cur.next++
+		w.push(cur.items[cur.next-1].group)
+	}
+}
+
+// nextCase returns the test case that the next test case result belongs to.
+func (w *planWalker) nextCase() (storage.ProblemTestcase, error) {
+	w.descend()
+	if len(w.stack) == 0 {
+		return storage.ProblemTestcase{}, fmt.Errorf("evaluator reported a test case result after the root group was finished")
+	}
+	cur := &w.stack[len(w.stack)-1]
+	if cur.next == len(cur.items) {
+		return storage.ProblemTestcase{}, fmt.Errorf("evaluator reported more test case results than group %s has test cases", cur.group.Name)
+	}
+	testcase := cur.items[cur.next].testcase
+	cur.next++
+	return w.source.cases[testcase], nil
+}
+
+// nextGroup returns the test group that the next test group result belongs to.
+func (w *planWalker) nextGroup() (*storage.ProblemTestgroup, error) {
+	w.descend()
+	if len(w.stack) == 0 {
+		return nil, fmt.Errorf("evaluator reported a test group result after the root group was finished")
+	}
+	group := w.stack[len(w.stack)-1].group
+	w.stack = w.stack[:len(w.stack)-1]
+	return w.source.groups[group], nil
+}
+
 type validatorConfig struct {
 	RunCommand []string `json:"run_command"`
 }
@@ -243,16 +642,14 @@ type graderConfig struct {
 	RunCommand []string `json:"run_command"`
 }
 
-func makeEvalPlan(program *apipb.CompiledProgram, version storage.ProblemVersion) (*apipb.EvaluationPlan, error) {
-	var groups []storage.ProblemTestgroup
-	if res := storage.GormDB.Debug().Where("problem_version_id = ?", version.ProblemVersionId).Preload("ProblemTestcases").Order("problem_testgroup_id asc").Find(&groups); res.Error != nil {
-		return nil, fmt.Errorf("failed gathering testdata: %v", res.Error)
-	}
-
+// makeEvalPlan makes the evaluation plan of a program for the test groups of a problem version, listing the test cases
+// and subgroups of each group in planOrder. It also returns what test data the plan was made from.
+func makeEvalPlan(store storage.Store, program *apipb.CompiledProgram, version storage.ProblemVersion, groups []*storage.ProblemTestgroup) (*apipb.EvaluationPlan, planSource, error) {
 	evalPlan := &apipb.EvaluationPlan{
 		Program:              program,
 		TimeLimitMs:          int32(version.TimeLimitMs),
 		MemLimitKb:           int32(version.MemoryLimitKb),
+		OutputLimitKb:        int32(version.OutputLimitKb),
 		ValidatorTimeLimitMs: 60_000,
 		ValidatorMemLimitKb:  1_000_000,
 	}
@@ -263,41 +660,55 @@ func makeEvalPlan(program *apipb.CompiledProgram, version storage.ProblemVersion
 	}
 	if version.OutputValidatorId != 0 {
 		evalPlan.ScoringValidator = version.OutputValidator.ScoringValidator
-		val, err := zipProgram(version.OutputValidator.ValidatorZipId, version.OutputValidator.RunCommand, "validators")
+		val, err := zipProgram(store, version.OutputValidator.ValidatorZipId, version.OutputValidator.RunCommand, "validators")
 		if err != nil {
-			return nil, fmt.Errorf("failed loading zip'ed validator: %v", err)
+			return nil, planSource{}, fmt.Errorf("failed loading zip'ed validator: %v", err)
 		}
 		evalPlan.Validator = val
 	}
 	if version.CustomGraderId != 0 {
-		grader, err := zipProgram(version.CustomGrader.GraderZipId, version.CustomGrader.RunCommand, "graders")
+		grader, err := zipProgram(store, version.CustomGrader.GraderZipId, version.CustomGrader.RunCommand, "graders")
 		if err != nil {
-			return nil, fmt.Errorf("failed loading zip'ed grader: %v", err)
+			return nil, planSource{}, fmt.Errorf("failed loading zip'ed grader: %v", err)
 		}
 		evalPlan.Grader = grader
 	}
 
+	source := planSource{
+		cases:  make(map[*apipb.TestCase]storage.ProblemTestcase),
+		groups: make(map[*apipb.TestGroup]*storage.ProblemTestgroup),
+	}
 	apigroups := make(map[int64]*apipb.TestGroup)
 	for _, group := range groups {
-		apigroup, err := toGroup(group)
+		apigroup, err := toGroup(store, group, source)
 		if err != nil {
-			return nil, fmt.Errorf("failed loading test group %d: %v", group.TestgroupName, err)
+			return nil, planSource{}, fmt.Errorf("failed loading test group %s: %v", group.TestgroupName, err)
 		}
 		apigroups[group.ProblemTestgroupId] = apigroup
+		source.groups[apigroup] = group
+	}
+	for _, group := range groups {
 		if group.ParentId != 0 {
-			apigroups[group.ParentId].Groups = append(apigroups[group.ParentId].Groups, apigroup)
+			apigroups[group.ParentId].Groups = append(apigroups[group.ParentId].Groups, apigroups[group.ProblemTestgroupId])
 		}
 	}
+	for _, apigroup := range apigroups {
+		sort.Slice(apigroup.Cases, func(i, j int) bool { return planOrder(apigroup.Cases[i].Name, apigroup.Cases[j].Name) })
+		sort.Slice(apigroup.Groups, func(i, j int) bool { return planOrder(apigroup.Groups[i].Name, apigroup.Groups[j].Name) })
+	}
 	evalPlan.RootGroup = apigroups[version.RootGroupId]
-	return evalPlan, nil
+	if evalPlan.RootGroup == nil {
+		return nil, planSource{}, fmt.Errorf("missing root group %d", version.RootGroupId)
+	}
+	return evalPlan, source, nil
 }
 
-func zipProgram(id string, runCmd []string, programType string) (*apipb.CompiledProgram, error) {
+func zipProgram(store storage.Store, id string, runCmd []string, programType string) (*apipb.CompiledProgram, error) {
 	logger.Infof("Loading validator %s", id)
-	valPath := filepath.Join("/var/lib/omogen/", programType, id)
+	valPath := filepath.Join(dataRoot, programType, id)
 	if _, err := os.Stat(valPath); err != nil {
 		if os.IsNotExist(err) {
-			if err := syncFiles([]string{id}); err != nil {
+			if err := syncFiles(store, []string{id}); err != nil {
 				return nil, err
 			}
 			zipPath, _ := findPath(id)
@@ -374,7 +785,7 @@ func toApiVerdictMode(verdictMode string) (apipb.VerdictMode, error) {
 	return apipb.VerdictMode_VERDICT_MODE_UNSPECIFIED, fmt.Errorf("unknown verdict mode: %s", verdictMode)
 }
 
-func toGroup(testgroup storage.ProblemTestgroup) (*apipb.TestGroup, error) {
+func toGroup(store storage.Store, testgroup *storage.ProblemTestgroup, source planSource) (*apipb.TestGroup, error) {
 	scoringMode, err := toApiScoringMode(testgroup.ScoringMode)
 	if err != nil {
 		return nil, err
@@ -401,11 +812,13 @@ func toGroup(testgroup storage.ProblemTestgroup) (*apipb.TestGroup, error) {
 	for _, testcase := range testgroup.ProblemTestcases {
 		inpath, hasin := findPath(testcase.InputFileHash)
 		outpath, hasout := findPath(testcase.OutputFileHash)
-		group.Cases = append(group.Cases, &apipb.TestCase{
+		apicase := &apipb.TestCase{
 			Name:       testcase.TestcaseName,
 			InputPath:  inpath,
 			OutputPath: outpath,
-		})
+		}
+		group.Cases = append(group.Cases, apicase)
+		source.cases[apicase] = testcase
 		if !hasin {
 			missingFiles = append(missingFiles, testcase.InputFileHash)
 		}
@@ -413,22 +826,21 @@ func toGroup(testgroup storage.ProblemTestgroup) (*apipb.TestGroup, error) {
 			missingFiles = append(missingFiles, testcase.OutputFileHash)
 		}
 	}
-	if err := syncFiles(missingFiles); err != nil {
+	if err := syncFiles(store, missingFiles); err != nil {
 		return nil, err
 	}
 	return group, nil
 }
 
-func syncFiles(fileIds []string) error {
+func syncFiles(store storage.Store, fileIds []string) error {
 	if len(fileIds) == 0 {
 		return nil
 	}
-	var files []storage.StoredFile
-	res := storage.GormDB.Find(&files, fileIds)
-	if res.Error != nil {
-		return fmt.Errorf("failed loading stored files: %v", res.Error)
+	files, err := store.LoadStoredFiles(fileIds)
+	if err != nil {
+		return fmt.Errorf("failed loading stored files: %v", err)
 	}
-	fb := util.NewFileBase("/var/lib/omogen/cache")
+	fb := util.NewFileBase(filepath.Join(dataRoot, "cache"))
 	fb.OwnerGid = util.OmogenexecGroupId()
 	for _, file := range files {
 		if err := fb.WriteFile(file.FileHash, file.FileContents); err != nil {
@@ -439,7 +851,7 @@ func syncFiles(fileIds []string) error {
 }
 
 func findPath(id string) (string, bool) {
-	path := fmt.Sprintf("/var/lib/omogen/cache/%s", id)
+	path := filepath.Join(dataRoot, "cache", id)
 	if _, err := os.Stat(path); err == nil {
 		return path, true
 	}
@@ -0,0 +1,1103 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	apipb "github.com/jsannemo/omogenexec/api"
+	"github.com/jsannemo/omogenexec/eval"
+	hostpb "github.com/jsannemo/omogenhost/judgehost/api"
+	"github.com/jsannemo/omogenhost/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testRunId      = 1
+	testLeaseOwner = "testhost:1"
+)
+
+// Test groups of the test problem. The secret group is split into two subgroups.
+const (
+	rootGroupId   = 1
+	sampleGroupId = 2
+	secretGroupId = 3
+	group1Id      = 4
+	group2Id      = 5
+)
+
+// fakeBackend compiles every program and replays scripted results instead of evaluating it.
+type fakeBackend struct {
+	// compilerErrors makes compilation fail with the given errors, if set.
+	compilerErrors string
+	results        []*apipb.Result
+	// plan is the plan that was evaluated, or nil if nothing was evaluated.
+	plan *apipb.EvaluationPlan
+	// blocked is closed once the scripted results are replayed, if set. The evaluation then runs until it is killed.
+	blocked chan struct{}
+	// killed is whether a blocked evaluation was killed.
+	killed bool
+	// judge judges the test cases of the plan instead of replaying results, if set. Group results are then computed by
+	// judgeGroup, with groupScoreBonus added to their score.
+	judge           func(testcase *apipb.TestCase) *apipb.Result
+	groupScoreBonus float64
+	mu              sync.Mutex
+	evaluations     int
+	// sandboxes are the sandboxes of the slots evaluations ran in.
+	sandboxes map[int]bool
+}
+
+func (b *fakeBackend) Compile(ctx context.Context, slot *evalSlot, program *apipb.Program, outputBase string) (*eval.CompileResult, error) {
+	if b.compilerErrors != "" {
+		return &eval.CompileResult{CompilerErrors: b.compilerErrors}, nil
+	}
+	return &eval.CompileResult{
+		Program: &apipb.CompiledProgram{ProgramRoot: outputBase, RunCommand: []string{"./main"}},
+	}, nil
+}
+
+func (b *fakeBackend) Evaluate(ctx context.Context, slot *evalSlot, root string, plan *apipb.EvaluationPlan, results chan<- *apipb.Result) error {
+	defer close(results)
+	b.mu.Lock()
+	b.plan = plan
+	b.evaluations++
+	if b.sandboxes == nil {
+		b.sandboxes = make(map[int]bool)
+	}
+	b.sandboxes[slot.sandbox] = true
+	b.mu.Unlock()
+	if b.judge != nil {
+		b.judgeGroup(plan.RootGroup, results)
+		return nil
+	}
+	for _, result := range b.results {
+		results <- result
+	}
+	if b.blocked != nil {
+		close(b.blocked)
+		<-ctx.Done()
+		b.killed = true
+		return ctx.Err()
+	}
+	return nil
+}
+
+// judgeGroup judges a group like the evaluator does for the groups of the tests, which have at most one kind of
+// error: the result of a group has the first error of its test cases and subgroups, their longest time and the sum of
+// their scores. The sample group doesn't count towards the result of a group that ignores it.
+func (b *fakeBackend) judgeGroup(group *apipb.TestGroup, results chan<- *apipb.Result) *apipb.Result {
+	groupResult := &apipb.Result{Type: apipb.ResultType_TEST_GROUP, Verdict: apipb.Verdict_ACCEPTED}
+	for _, item := range judgingOrder(group) {
+		var result *apipb.Result
+		if item.testcase != nil {
+			result = b.judge(item.testcase)
+			results <- result
+		} else {
+			result = b.judgeGroup(item.group, results)
+			if group.IgnoreSample && strings.HasSuffix(item.group.Name, "/sample") {
+				continue
+			}
+		}
+		if groupResult.Verdict == apipb.Verdict_ACCEPTED {
+			groupResult.Verdict = result.Verdict
+		}
+		if result.TimeUsageMs > groupResult.TimeUsageMs {
+			groupResult.TimeUsageMs = result.TimeUsageMs
+		}
+		groupResult.Score += result.Score
+		if group.BreakOnFail && result.Verdict != apipb.Verdict_ACCEPTED {
+			break
+		}
+	}
+	groupResult.Score += b.groupScoreBonus
+	results <- groupResult
+	return groupResult
+}
+
+func caseResult(verdict apipb.Verdict, timeMs int64, score float64) *apipb.Result {
+	return &apipb.Result{
+		Type:        apipb.ResultType_TEST_CASE,
+		Verdict:     verdict,
+		TimeUsageMs: timeMs,
+		Score:       score,
+	}
+}
+
+func groupResult(verdict apipb.Verdict, timeMs int64, score float64) *apipb.Result {
+	return &apipb.Result{
+		Type:        apipb.ResultType_TEST_GROUP,
+		Verdict:     verdict,
+		TimeUsageMs: timeMs,
+		Score:       score,
+	}
+}
+
+// judgeTest judges the single run of a test problem against an in-memory store.
+type judgeTest struct {
+	store    *storage.MemoryStore
+	backend  *fakeBackend
+	progress []*hostpb.EvaluateProgress
+}
+
+func newTestGroup(id int64, parentId int64, name string, caseIds ...int64) storage.ProblemTestgroup {
+	group := storage.ProblemTestgroup{
+		ProblemTestgroupId: id,
+		ParentId:           parentId,
+		ProblemVersionId:   1,
+		TestgroupName:      name,
+		ScoringMode:        storage.ScoringModeSum,
+		VerdictMode:        storage.VerdictModeWorstError,
+	}
+	for _, caseId := range caseIds {
+		group.ProblemTestcases = append(group.ProblemTestcases, storage.ProblemTestcase{
+			ProblemTestcaseId:  caseId,
+			ProblemTestgroupId: id,
+			TestcaseName:       fmt.Sprintf("%s/%d", name, caseId),
+			InputFileHash:      fmt.Sprintf("in%d", caseId),
+			OutputFileHash:     fmt.Sprintf("ans%d", caseId),
+		})
+	}
+	return group
+}
+
+// newJudgeTest sets up a problem with samples and two secret groups, with group 1 breaking on reject,
+// and a queued run of it.
+func newJudgeTest(t *testing.T, scoring bool) *judgeTest {
+	if evalSlots == nil {
+		if err := initSlots(1, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldDataRoot, oldBackend := dataRoot, backend
+	t.Cleanup(func() { dataRoot, backend = oldDataRoot, oldBackend })
+	dataRoot = t.TempDir()
+	test := &judgeTest{
+		store:   storage.NewMemoryStore(),
+		backend: &fakeBackend{},
+	}
+	backend = test.backend
+
+	test.store.AddProblemVersion(storage.ProblemVersion{
+		ProblemVersionId: 1,
+		RootGroupId:      rootGroupId,
+		TimeLimitMs:      1000,
+		MemoryLimitKb:    256_000,
+		OutputLimitKb:    8_000,
+		IncludedFiles:    storage.JSON("{}"),
+		Scoring:          scoring,
+	})
+	samples := newTestGroup(sampleGroupId, rootGroupId, "data/sample", 21, 22)
+	samples.IsSample = true
+	group1 := newTestGroup(group1Id, secretGroupId, "data/secret/group1", 41, 42)
+	group1.BreakOnReject = true
+	for _, group := range []storage.ProblemTestgroup{
+		newTestGroup(rootGroupId, 0, "data"),
+		samples,
+		newTestGroup(secretGroupId, rootGroupId, "data/secret"),
+		group1,
+		newTestGroup(group2Id, secretGroupId, "data/secret/group2", 51),
+	} {
+		test.addTestgroup(t, group)
+	}
+
+	source := base64.StdEncoding.EncodeToString([]byte("int main() {}"))
+	test.store.AddSubmission(storage.Submission{
+		SubmissionId:    1,
+		Language:        "cpp",
+		SubmissionFiles: storage.JSON(fmt.Sprintf(`{"Files": {"main.cpp": %q}}`, source)),
+	})
+	test.store.AddRun(storage.SubmissionRun{
+		SubmissionRunId:  testRunId,
+		SubmissionId:     1,
+		ProblemVersionId: 1,
+		Status:           storage.StatusQueued,
+		Verdict:          storage.VerdictUnjudged,
+	})
+	return test
+}
+
+// addTestgroup adds a test group to the problem, caching its test data so that it doesn't have to be synced from the
+// store.
+func (test *judgeTest) addTestgroup(t *testing.T, group storage.ProblemTestgroup) {
+	test.store.AddTestgroup(group)
+	for _, testcase := range group.ProblemTestcases {
+		for _, hash := range []string{testcase.InputFileHash, testcase.OutputFileHash} {
+			if err := os.MkdirAll(filepath.Join(dataRoot, "cache"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(dataRoot, "cache", hash), []byte("1\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func (test *judgeTest) evaluate() error {
+	return evaluate(context.Background(), test.store, testRunId, testLeaseOwner, func(progress *hostpb.EvaluateProgress) {
+		test.progress = append(test.progress, progress)
+	})
+}
+
+func (test *judgeTest) run(t *testing.T) storage.SubmissionRun {
+	run, found := test.store.Run(testRunId)
+	if !found {
+		t.Fatalf("run %d is missing", testRunId)
+	}
+	return run
+}
+
+func caseRunsById(caseRuns []storage.SubmissionCaseRun) map[int64]storage.SubmissionCaseRun {
+	byId := make(map[int64]storage.SubmissionCaseRun)
+	for _, caseRun := range caseRuns {
+		byId[caseRun.ProblemTestcaseId] = caseRun
+	}
+	return byId
+}
+
+func groupRunsById(groupRuns []storage.SubmissionGroupRun) map[int64]storage.SubmissionGroupRun {
+	byId := make(map[int64]storage.SubmissionGroupRun)
+	for _, groupRun := range groupRuns {
+		byId[groupRun.ProblemTestgroupId] = groupRun
+	}
+	return byId
+}
+
+func TestEvaluateNestedGroups(t *testing.T) {
+	test := newJudgeTest(t, false)
+	test.backend.results = []*apipb.Result{
+		caseResult(apipb.Verdict_ACCEPTED, 10, 0),  // test case 21
+		caseResult(apipb.Verdict_ACCEPTED, 20, 0),  // test case 22
+		groupResult(apipb.Verdict_ACCEPTED, 20, 0), // sample group
+		caseResult(apipb.Verdict_ACCEPTED, 30, 0),  // test case 41
+		caseResult(apipb.Verdict_ACCEPTED, 40, 0),  // test case 42
+		groupResult(apipb.Verdict_ACCEPTED, 40, 0), // group 1
+		caseResult(apipb.Verdict_ACCEPTED, 50, 0),  // test case 51
+		groupResult(apipb.Verdict_ACCEPTED, 50, 0), // group 2
+		groupResult(apipb.Verdict_ACCEPTED, 50, 0), // secret group
+		groupResult(apipb.Verdict_ACCEPTED, 50, 0), // root group
+	}
+	if err := test.evaluate(); err != nil {
+		t.Fatalf("evaluate failed: %v", err)
+	}
+
+	plan := test.backend.plan
+	if plan == nil {
+		t.Fatal("run was never evaluated")
+	}
+	if plan.TimeLimitMs != 1000 || plan.MemLimitKb != 256_000 || plan.OutputLimitKb != 8_000 {
+		t.Errorf("got limits of %d ms, %d kB of memory and %d kB of output, want those of the problem", plan.TimeLimitMs, plan.MemLimitKb, plan.OutputLimitKb)
+	}
+	if plan.RootGroup.Name != "data" || len(plan.RootGroup.Groups) != 2 {
+		t.Fatalf("unexpected root group in plan: %v", plan.RootGroup)
+	}
+	secret := plan.RootGroup.Groups[1]
+	if secret.Name != "data/secret" || len(secret.Groups) != 2 || secret.Groups[0].Name != "data/secret/group1" || secret.Groups[1].Name != "data/secret/group2" {
+		t.Fatalf("unexpected secret group in plan: %v", secret)
+	}
+	if !secret.Groups[0].BreakOnFail || secret.Groups[1].BreakOnFail {
+		t.Errorf("break on reject was not carried over to the plan")
+	}
+	if len(secret.Groups[0].Cases) != 2 || secret.Groups[0].Cases[1].Name != "data/secret/group1/42" {
+		t.Errorf("unexpected cases of group 1 in plan: %v", secret.Groups[0].Cases)
+	}
+
+	run := test.run(t)
+	if run.Status != storage.StatusDone || run.Verdict != storage.VerdictAccepted {
+		t.Errorf("got run with status %q and verdict %q, want done and accepted", run.Status, run.Verdict)
+	}
+	if run.TimeUsageMs != 50 {
+		t.Errorf("got run using %d ms, want 50 ms", run.TimeUsageMs)
+	}
+	if run.LeaseOwner.Valid {
+		t.Errorf("lease on run was not released")
+	}
+
+	caseRuns := caseRunsById(test.store.CaseRuns(testRunId))
+	if len(caseRuns) != 5 {
+		t.Fatalf("got %d test case results, want 5", len(caseRuns))
+	}
+	if caseRuns[41].TimeUsageMs != 30 || caseRuns[41].AttemptId != run.AttemptId {
+		t.Errorf("unexpected result of test case 41: %+v", caseRuns[41])
+	}
+	groupRuns := groupRunsById(test.store.GroupRuns(testRunId))
+	if len(groupRuns) != 5 {
+		t.Fatalf("got %d test group results, want 5", len(groupRuns))
+	}
+	for groupId, timeMs := range map[int64]int64{sampleGroupId: 20, group1Id: 40, group2Id: 50, secretGroupId: 50, rootGroupId: 50} {
+		if got := groupRuns[groupId].TimeUsageMs; got != timeMs {
+			t.Errorf("got %d ms used by group %d, want %d ms", got, groupId, timeMs)
+		}
+	}
+
+	var caseIndices []int
+	for _, progress := range test.store.Progress() {
+		if progress.TestcaseIndex != nil {
+			caseIndices = append(caseIndices, *progress.TestcaseIndex)
+		}
+	}
+	if fmt.Sprint(caseIndices) != "[0 1 2 3 4]" {
+		t.Errorf("got progress for test cases %v, want them in judging order", caseIndices)
+	}
+	if compiled := test.progress[0].GetCompileFinished(); compiled == nil || !compiled.Success {
+		t.Errorf("first reported progress was %v, want a successful compilation", test.progress[0])
+	}
+}
+
+func TestEvaluateCompileError(t *testing.T) {
+	test := newJudgeTest(t, false)
+	test.backend.compilerErrors = "main.cpp:1: error: expected ';'"
+	if err := test.evaluate(); err != nil {
+		t.Fatalf("evaluate failed: %v", err)
+	}
+
+	if test.backend.plan != nil {
+		t.Errorf("program that failed to compile was evaluated")
+	}
+	run := test.run(t)
+	if run.Status != storage.StatusCompileError || run.CompileError != test.backend.compilerErrors {
+		t.Errorf("got run with status %q and compile error %q, want a compile error", run.Status, run.CompileError)
+	}
+	if caseRuns := test.store.CaseRuns(testRunId); len(caseRuns) != 0 {
+		t.Errorf("got %d test case results for a compile error", len(caseRuns))
+	}
+	if len(test.progress) != 1 || test.progress[0].GetCompileFinished().GetSuccess() {
+		t.Errorf("got progress %v, want only a failed compilation", test.progress)
+	}
+}
+
+func TestEvaluateBreakOnReject(t *testing.T) {
+	test := newJudgeTest(t, false)
+	// The evaluator stops judging group 1 after its first rejected test case.
+	test.backend.results = []*apipb.Result{
+		caseResult(apipb.Verdict_ACCEPTED, 10, 0),               // test case 21
+		caseResult(apipb.Verdict_ACCEPTED, 10, 0),               // test case 22
+		groupResult(apipb.Verdict_ACCEPTED, 10, 0),              // sample group
+		caseResult(apipb.Verdict_WRONG_ANSWER, 30, 0),           // test case 41
+		groupResult(apipb.Verdict_WRONG_ANSWER, 30, 0),          // group 1
+		caseResult(apipb.Verdict_TIME_LIMIT_EXCEEDED, 1000, 0),  // test case 51
+		groupResult(apipb.Verdict_TIME_LIMIT_EXCEEDED, 1000, 0), // group 2
+		groupResult(apipb.Verdict_WRONG_ANSWER, 1000, 0),        // secret group
+		groupResult(apipb.Verdict_WRONG_ANSWER, 1000, 0),        // root group
+	}
+	if err := test.evaluate(); err != nil {
+		t.Fatalf("evaluate failed: %v", err)
+	}
+
+	run := test.run(t)
+	if run.Status != storage.StatusDone || run.Verdict != storage.VerdictWrongAnswer {
+		t.Errorf("got run with status %q and verdict %q, want done and wrong answer", run.Status, run.Verdict)
+	}
+	caseRuns := caseRunsById(test.store.CaseRuns(testRunId))
+	if len(caseRuns) != 4 {
+		t.Fatalf("got %d test case results, want 4", len(caseRuns))
+	}
+	if _, found := caseRuns[42]; found {
+		t.Errorf("got a result for test case 42, which was never judged")
+	}
+	if caseRuns[41].Verdict != storage.VerdictWrongAnswer || caseRuns[51].Verdict != storage.VerdictTimeLimitExceeded {
+		t.Errorf("got verdicts %q and %q for test cases 41 and 51", caseRuns[41].Verdict, caseRuns[51].Verdict)
+	}
+	groupRuns := groupRunsById(test.store.GroupRuns(testRunId))
+	if groupRuns[group1Id].Verdict != storage.VerdictWrongAnswer || groupRuns[group2Id].Verdict != storage.VerdictTimeLimitExceeded {
+		t.Errorf("got verdicts %q and %q for groups 1 and 2", groupRuns[group1Id].Verdict, groupRuns[group2Id].Verdict)
+	}
+}
+
+func TestEvaluateScoring(t *testing.T) {
+	test := newJudgeTest(t, true)
+	test.backend.results = []*apipb.Result{
+		caseResult(apipb.Verdict_ACCEPTED, 10, 0),       // test case 21
+		caseResult(apipb.Verdict_ACCEPTED, 10, 0),       // test case 22
+		groupResult(apipb.Verdict_ACCEPTED, 10, 0),      // sample group
+		caseResult(apipb.Verdict_ACCEPTED, 30, 15),      // test case 41
+		caseResult(apipb.Verdict_ACCEPTED, 30, 15),      // test case 42
+		groupResult(apipb.Verdict_ACCEPTED, 30, 30),     // group 1
+		caseResult(apipb.Verdict_WRONG_ANSWER, 30, 0),   // test case 51
+		groupResult(apipb.Verdict_WRONG_ANSWER, 30, 0),  // group 2
+		groupResult(apipb.Verdict_WRONG_ANSWER, 30, 30), // secret group
+		groupResult(apipb.Verdict_WRONG_ANSWER, 30, 30), // root group
+	}
+	if err := test.evaluate(); err != nil {
+		t.Fatalf("evaluate failed: %v", err)
+	}
+
+	run := test.run(t)
+	if run.Score != 30 || run.Verdict != storage.VerdictWrongAnswer {
+		t.Errorf("got run with score %v and verdict %q, want 30 and wrong answer", run.Score, run.Verdict)
+	}
+	caseRuns := caseRunsById(test.store.CaseRuns(testRunId))
+	if caseRuns[41].Score != 15 || caseRuns[51].Score != 0 {
+		t.Errorf("got scores %v and %v for test cases 41 and 51, want 15 and 0", caseRuns[41].Score, caseRuns[51].Score)
+	}
+	groupRuns := groupRunsById(test.store.GroupRuns(testRunId))
+	for groupId, score := range map[int64]float64{group1Id: 30, group2Id: 0, secretGroupId: 30, rootGroupId: 30} {
+		if got := groupRuns[groupId].Score; got != score {
+			t.Errorf("got score %v for group %d, want %v", got, groupId, score)
+		}
+	}
+}
+
+func TestEvaluateUnexpectedResult(t *testing.T) {
+	test := newJudgeTest(t, false)
+	// The sample group only has two test cases.
+	test.backend.results = []*apipb.Result{
+		caseResult(apipb.Verdict_ACCEPTED, 10, 0), // test case 21
+		caseResult(apipb.Verdict_ACCEPTED, 10, 0), // test case 22
+		caseResult(apipb.Verdict_ACCEPTED, 10, 0),
+		groupResult(apipb.Verdict_ACCEPTED, 10, 0), // sample group
+	}
+	err := test.evaluate()
+	jerr := asJudgeError(err)
+	if jerr == nil || jerr.Reason != storage.JudgeErrorEvaluator {
+		t.Fatalf("got error %v, want an evaluator judging error", err)
+	}
+
+	run := test.run(t)
+	if run.Status != storage.StatusJudgeError || run.JudgeErrorReason != storage.JudgeErrorEvaluator {
+		t.Errorf("got run with status %q and reason %q, want an evaluator judging error", run.Status, run.JudgeErrorReason)
+	}
+	if caseRuns := test.store.CaseRuns(testRunId); len(caseRuns) != 0 {
+		t.Errorf("got %d test case results for a run that failed to be judged", len(caseRuns))
+	}
+}
+
+func TestEvaluateRunClaimedByOtherHost(t *testing.T) {
+	test := newJudgeTest(t, false)
+	if claimed, err := test.store.ClaimRun(testRunId, "otherhost:1"); !claimed || err != nil {
+		t.Fatalf("failed claiming run: %v", err)
+	}
+	if err := test.evaluate(); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("got error %v, want the run to be refused", err)
+	}
+	if test.backend.plan != nil {
+		t.Error("run claimed by another host was evaluated")
+	}
+	if run := test.run(t); run.LeaseOwner.String != "otherhost:1" {
+		t.Errorf("got run leased by %v, want it left to the other host", run.LeaseOwner)
+	}
+}
+
+func TestEvaluateLostLeaseStopsEvaluation(t *testing.T) {
+	oldInterval := leaseRenewInterval
+	t.Cleanup(func() { leaseRenewInterval = oldInterval })
+	leaseRenewInterval = 10 * time.Millisecond
+	test := newJudgeTest(t, false)
+	test.backend.results = []*apipb.Result{
+		caseResult(apipb.Verdict_ACCEPTED, 10, 0), // test case 21
+	}
+	test.backend.blocked = make(chan struct{})
+	go func() {
+		<-test.backend.blocked
+		// The queue gave up on the judgehost and requeued the run.
+		if _, err := test.store.RequeueRun(testRunId); err != nil {
+			t.Error(err)
+		}
+	}()
+	if err := test.evaluate(); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("got error %v, want the evaluation to stop", err)
+	}
+	if !test.backend.killed {
+		t.Error("evaluation was not killed")
+	}
+	if run := test.run(t); run.Status != storage.StatusQueued {
+		t.Errorf("got run with status %q, want it left queued", run.Status)
+	}
+	if caseRuns := test.store.CaseRuns(testRunId); len(caseRuns) != 0 {
+		t.Errorf("got results %v written after the lease was lost", caseRuns)
+	}
+}
+
+func TestToStorageVerdict(t *testing.T) {
+	for verdict, want := range map[apipb.Verdict]storage.Verdict{
+		apipb.Verdict_ACCEPTED:              storage.VerdictAccepted,
+		apipb.Verdict_WRONG_ANSWER:          storage.VerdictWrongAnswer,
+		apipb.Verdict_TIME_LIMIT_EXCEEDED:   storage.VerdictTimeLimitExceeded,
+		apipb.Verdict_RUN_TIME_ERROR:        storage.VerdictRuntimeError,
+		apipb.Verdict_MEMORY_LIMIT_EXCEEDED: storage.VerdictMemoryLimitExceeded,
+		apipb.Verdict_OUTPUT_LIMIT_EXCEEDED: storage.VerdictOutputLimitExceeded,
+		apipb.Verdict_JUDGE_ERROR:           storage.VerdictJudgeError,
+	} {
+		if got, err := toStorageVerdict(verdict); err != nil || got != want {
+			t.Errorf("got %q (%v) for verdict %v, want %q", got, err, verdict, want)
+		}
+	}
+	if _, err := toStorageVerdict(apipb.Verdict_VERDICT_UNSPECIFIED); err == nil {
+		t.Error("unspecified verdict was accepted")
+	}
+}
+
+func TestEvaluateResourceLimitVerdicts(t *testing.T) {
+	test := newJudgeTest(t, false)
+	test.backend.results = []*apipb.Result{
+		caseResult(apipb.Verdict_MEMORY_LIMIT_EXCEEDED, 10, 0),  // test case 21
+		caseResult(apipb.Verdict_OUTPUT_LIMIT_EXCEEDED, 20, 0),  // test case 22
+		groupResult(apipb.Verdict_MEMORY_LIMIT_EXCEEDED, 20, 0), // sample group
+		caseResult(apipb.Verdict_ACCEPTED, 30, 0),               // test case 41
+		caseResult(apipb.Verdict_ACCEPTED, 40, 0),               // test case 42
+		groupResult(apipb.Verdict_ACCEPTED, 40, 0),              // group 1
+		caseResult(apipb.Verdict_ACCEPTED, 50, 0),               // test case 51
+		groupResult(apipb.Verdict_ACCEPTED, 50, 0),              // group 2
+		groupResult(apipb.Verdict_ACCEPTED, 50, 0),              // secret group
+		groupResult(apipb.Verdict_MEMORY_LIMIT_EXCEEDED, 50, 0), // root group
+	}
+	if err := test.evaluate(); err != nil {
+		t.Fatalf("evaluate failed: %v", err)
+	}
+
+	run := test.run(t)
+	if run.Status != storage.StatusDone || run.Verdict != storage.VerdictMemoryLimitExceeded {
+		t.Errorf("got run with status %q and verdict %q, want done and memory limit exceeded", run.Status, run.Verdict)
+	}
+	caseRuns := caseRunsById(test.store.CaseRuns(testRunId))
+	if verdict := caseRuns[21].Verdict; verdict != storage.VerdictMemoryLimitExceeded {
+		t.Errorf("got verdict %q for test case 21, want memory limit exceeded", verdict)
+	}
+	if verdict := caseRuns[22].Verdict; verdict != storage.VerdictOutputLimitExceeded {
+		t.Errorf("got verdict %q for test case 22, want output limit exceeded", verdict)
+	}
+	if verdict := groupRunsById(test.store.GroupRuns(testRunId))[sampleGroupId].Verdict; verdict != storage.VerdictMemoryLimitExceeded {
+		t.Errorf("got verdict %q for the sample group, want memory limit exceeded", verdict)
+	}
+}
+
+func TestEvaluateJudgeErrorVerdict(t *testing.T) {
+	test := newJudgeTest(t, false)
+	test.backend.results = []*apipb.Result{
+		caseResult(apipb.Verdict_JUDGE_ERROR, 10, 0),  // test case 21
+		caseResult(apipb.Verdict_ACCEPTED, 20, 0),     // test case 22
+		groupResult(apipb.Verdict_JUDGE_ERROR, 20, 0), // sample group
+		caseResult(apipb.Verdict_ACCEPTED, 30, 0),     // test case 41
+		caseResult(apipb.Verdict_ACCEPTED, 40, 0),     // test case 42
+		groupResult(apipb.Verdict_ACCEPTED, 40, 0),    // group 1
+		caseResult(apipb.Verdict_ACCEPTED, 50, 0),     // test case 51
+		groupResult(apipb.Verdict_ACCEPTED, 50, 0),    // group 2
+		groupResult(apipb.Verdict_ACCEPTED, 50, 0),    // secret group
+		groupResult(apipb.Verdict_JUDGE_ERROR, 50, 0), // root group
+	}
+	var judgeErr *judgeError
+	if err := test.evaluate(); !errors.As(err, &judgeErr) {
+		t.Fatalf("got error %v, want a judging error", err)
+	}
+
+	run := test.run(t)
+	if run.Status != storage.StatusJudgeError || run.Verdict != storage.VerdictJudgeError || run.JudgeErrorReason != storage.JudgeErrorEvaluator {
+		t.Errorf("got run with status %q, verdict %q and reason %q, want an evaluator judging error", run.Status, run.Verdict, run.JudgeErrorReason)
+	}
+}
+
+func TestEvaluateReplacesResultsOfEarlierAttempts(t *testing.T) {
+	test := newJudgeTest(t, false)
+	// An earlier attempt left results behind, e.g. because the run was rejudged without removing them.
+	if claimed, err := test.store.ClaimRun(testRunId, "otherhost:1"); !claimed || err != nil {
+		t.Fatalf("failed claiming run: %v", err)
+	}
+	staleCase := storage.SubmissionCaseRun{SubmissionRunId: testRunId, ProblemTestcaseId: 21, Verdict: storage.VerdictWrongAnswer, AttemptId: "otherhost:1/1"}
+	staleGroup := storage.SubmissionGroupRun{SubmissionRunId: testRunId, ProblemTestgroupId: sampleGroupId, Verdict: storage.VerdictWrongAnswer, AttemptId: "otherhost:1/1"}
+	if err := test.store.WriteResults(testRunId, "otherhost:1", []storage.SubmissionCaseRun{staleCase}, []storage.SubmissionGroupRun{staleGroup}); err != nil {
+		t.Fatal(err)
+	}
+	run := test.run(t)
+	run.Status = storage.StatusQueued
+	run.LeaseOwner = sql.NullString{}
+	test.store.AddRun(run)
+
+	test.backend.results = []*apipb.Result{
+		caseResult(apipb.Verdict_ACCEPTED, 10, 0),  // test case 21
+		caseResult(apipb.Verdict_ACCEPTED, 10, 0),  // test case 22
+		groupResult(apipb.Verdict_ACCEPTED, 10, 0), // sample group
+		caseResult(apipb.Verdict_ACCEPTED, 10, 0),  // test case 41
+		caseResult(apipb.Verdict_ACCEPTED, 10, 0),  // test case 42
+		groupResult(apipb.Verdict_ACCEPTED, 10, 0), // group 1
+		caseResult(apipb.Verdict_ACCEPTED, 10, 0),  // test case 51
+		groupResult(apipb.Verdict_ACCEPTED, 10, 0), // group 2
+		groupResult(apipb.Verdict_ACCEPTED, 10, 0), // secret group
+		groupResult(apipb.Verdict_ACCEPTED, 10, 0), // root group
+	}
+	if err := test.evaluate(); err != nil {
+		t.Fatal(err)
+	}
+
+	run = test.run(t)
+	caseRuns := test.store.CaseRuns(testRunId)
+	if len(caseRuns) != 5 {
+		t.Fatalf("got %d test case results, want 5", len(caseRuns))
+	}
+	for _, caseRun := range caseRuns {
+		if caseRun.AttemptId != run.AttemptId || caseRun.Verdict != storage.VerdictAccepted {
+			t.Errorf("got test case result %+v, want only results of attempt %s", caseRun, run.AttemptId)
+		}
+	}
+	if groupRuns := test.store.GroupRuns(testRunId); len(groupRuns) != 5 {
+		t.Errorf("got %d test group results, want 5", len(groupRuns))
+	}
+}
+
+// failingResultStore fails to write any results.
+type failingResultStore struct {
+	*storage.MemoryStore
+}
+
+func (s failingResultStore) WriteResults(int64, string, []storage.SubmissionCaseRun, []storage.SubmissionGroupRun) error {
+	return errors.New("database unavailable")
+}
+
+func TestEvaluateFailedResultWrite(t *testing.T) {
+	test := newJudgeTest(t, false)
+	test.backend.results = []*apipb.Result{
+		caseResult(apipb.Verdict_ACCEPTED, 10, 0),  // test case 21
+		caseResult(apipb.Verdict_ACCEPTED, 10, 0),  // test case 22
+		groupResult(apipb.Verdict_ACCEPTED, 10, 0), // sample group
+	}
+	err := evaluate(context.Background(), failingResultStore{test.store}, testRunId, testLeaseOwner, func(*hostpb.EvaluateProgress) {})
+	if err == nil {
+		t.Fatal("evaluation succeeded without writing its results")
+	}
+	for _, progress := range test.store.Progress() {
+		if progress.TestcaseIndex != nil {
+			t.Errorf("got progress %+v for a test case result that was never written", progress)
+		}
+	}
+}
+
+func TestEvaluateCancelKillsEvaluation(t *testing.T) {
+	test := newJudgeTest(t, false)
+	test.backend.results = []*apipb.Result{
+		caseResult(apipb.Verdict_ACCEPTED, 10, 0), // test case 21
+	}
+	test.backend.blocked = make(chan struct{})
+	go func() {
+		<-test.backend.blocked
+		activeRuns.cancel(testRunId)
+	}()
+	if err := test.evaluate(); status.Code(err) != codes.Canceled {
+		t.Fatalf("got error %v, want the run to be cancelled", err)
+	}
+
+	if !test.backend.killed {
+		t.Error("evaluation was not killed")
+	}
+	if len(evalSlots) != cap(evalSlots) {
+		t.Error("slot of the cancelled run was not released")
+	}
+	if run := test.run(t); run.Status != storage.StatusCancelled {
+		t.Errorf("got run with status %q, want it cancelled", run.Status)
+	}
+	if caseRuns := test.store.CaseRuns(testRunId); len(caseRuns) != 0 {
+		t.Errorf("got results %v of a cancelled run", caseRuns)
+	}
+}
+
+func TestEvaluateCancelWhileWaitingForSlot(t *testing.T) {
+	test := newJudgeTest(t, false)
+	slot, err := acquireSlot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slot.release()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := evaluate(ctx, test.store, testRunId, testLeaseOwner, func(*hostpb.EvaluateProgress) {}); err != context.Canceled {
+		t.Fatalf("got error %v, want the evaluation to give up waiting for a slot", err)
+	}
+	if run := test.run(t); run.Status != storage.StatusQueued {
+		t.Errorf("got run with status %q, want it still queued", run.Status)
+	}
+	// The queue must see the cancellation as such, not as an unknown error.
+	server := &JudgehostServer{store: test.store, leaseOwner: testLeaseOwner}
+	if _, err := server.Evaluate(ctx, &hostpb.EvaluateRequest{RunId: testRunId}); status.Code(err) != codes.Canceled {
+		t.Errorf("got error %v from the server, want it cancelled", err)
+	}
+}
+
+func TestEvaluateAbortedKeepsRunLeased(t *testing.T) {
+	test := newJudgeTest(t, false)
+	test.backend.blocked = make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-test.backend.blocked
+		// The caller went away, e.g. because the queue restarted.
+		cancel()
+	}()
+	if err := evaluate(ctx, test.store, testRunId, testLeaseOwner, func(*hostpb.EvaluateProgress) {}); status.Code(err) != codes.Aborted {
+		t.Fatalf("got error %v, want the evaluation to be aborted", err)
+	}
+	run := test.run(t)
+	if run.Status != storage.StatusRunning {
+		t.Errorf("got run with status %q, want it left running", run.Status)
+	}
+	if !run.LeaseOwner.Valid || run.LeaseOwner.String != testLeaseOwner {
+		t.Errorf("got run leased by %v, want it left leased until the lease expires", run.LeaseOwner)
+	}
+}
+
+func TestEvaluateDeadlineExceededIsJudgeError(t *testing.T) {
+	test := newJudgeTest(t, false)
+	test.backend.blocked = make(chan struct{})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := evaluate(ctx, test.store, testRunId, testLeaseOwner, func(*hostpb.EvaluateProgress) {}); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("got error %v, want the evaluation to run out of time", err)
+	}
+	run := test.run(t)
+	if run.Status != storage.StatusJudgeError || run.JudgeErrorReason != storage.JudgeErrorAborted {
+		t.Errorf("got run with status %q (%q), want it aborted as a judging error", run.Status, run.JudgeErrorReason)
+	}
+	if run.LeaseOwner.Valid {
+		t.Errorf("lease on run was not released")
+	}
+}
+
+func TestEvaluateOrdersNamesAsNumbers(t *testing.T) {
+	for _, parallel := range []bool{false, true} {
+		t.Run(fmt.Sprintf("parallel=%v", parallel), func(t *testing.T) {
+			testOrdersNamesAsNumbers(t, parallel)
+		})
+	}
+}
+
+func testOrdersNamesAsNumbers(t *testing.T, parallel bool) {
+	test := newJudgeTest(t, true)
+	test.backend.judge = judgeByName
+	if parallel {
+		useParallelSlot(t, 2)
+	}
+	// The names of the secret groups and of the test cases of group 9 are ordered differently as strings and as numbers,
+	// and are stored in the string order.
+	test.addTestgroup(t, newTestGroup(group1Id, secretGroupId, "data/secret/10", 41, 42))
+	test.addTestgroup(t, newTestGroup(group2Id, secretGroupId, "data/secret/9", 10, 9))
+	if err := test.evaluate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The parts of a plan judged in parallel are split from the same plan.
+	if !parallel {
+		secret := test.backend.plan.RootGroup.Groups[1]
+		if len(secret.Groups) != 2 || secret.Groups[0].Name != "data/secret/9" || secret.Groups[1].Name != "data/secret/10" {
+			t.Fatalf("got secret subgroups %v, want them ordered as numbers", secret.Groups)
+		}
+		if cases := secret.Groups[0].Cases; len(cases) != 2 || cases[0].Name != "data/secret/9/9" || cases[1].Name != "data/secret/9/10" {
+			t.Fatalf("got test cases %v of group 9, want them ordered as numbers", cases)
+		}
+	}
+	test.checkResults(t, map[int64]storage.SubmissionCaseRun{
+		9:  {TimeUsageMs: 9, Score: 1, Verdict: storage.VerdictAccepted},
+		10: {TimeUsageMs: 10, Score: 1, Verdict: storage.VerdictAccepted},
+		41: {TimeUsageMs: 41, Score: 1, Verdict: storage.VerdictAccepted},
+		42: {TimeUsageMs: 42, Score: 0, Verdict: storage.VerdictWrongAnswer},
+	}, map[int64]storage.SubmissionGroupRun{
+		group1Id: {TimeUsageMs: 42, Score: 1, Verdict: storage.VerdictWrongAnswer},
+		group2Id: {TimeUsageMs: 10, Score: 2, Verdict: storage.VerdictAccepted},
+	})
+}
+
+func TestPlanOrder(t *testing.T) {
+	for _, names := range [][2]string{
+		{"data/secret/9", "data/secret/10"},
+		{"data/secret/group2", "data/secret/group10"},
+		{"data/sample", "data/secret"},
+		{"data/secret/1-a", "data/secret/1-b"},
+		{"data/secret/01", "data/secret/1"},
+		{"data/secret/1", "data/secret/1a"},
+		{"data/secret/9", "data/secret/a"},
+	} {
+		if !planOrder(names[0], names[1]) || planOrder(names[1], names[0]) {
+			t.Errorf("got %s and %s in the wrong order", names[1], names[0])
+		}
+	}
+}
+
+// judgeByName judges test cases by their name: case 42 gets wrong answer, and the others are accepted.
+func judgeByName(testcase *apipb.TestCase) *apipb.Result {
+	var id int64
+	fmt.Sscanf(testcase.Name[strings.LastIndex(testcase.Name, "/")+1:], "%d", &id)
+	if id == 42 {
+		return caseResult(apipb.Verdict_WRONG_ANSWER, id, 0)
+	}
+	return caseResult(apipb.Verdict_ACCEPTED, id, 1)
+}
+
+// useParallelSlot makes the test judge test cases in parallel in a single slot with the given number of CPUs.
+func useParallelSlot(t *testing.T, cpus int) {
+	oldSlots, oldParallel := evalSlots, parallelCases
+	t.Cleanup(func() { evalSlots, parallelCases = oldSlots, oldParallel })
+	var slotCpus []int
+	for i := 0; i < cpus; i++ {
+		slotCpus = append(slotCpus, i)
+	}
+	if err := initSlots(1, [][]int{slotCpus}); err != nil {
+		t.Fatal(err)
+	}
+	parallelCases = true
+}
+
+func TestInitSlotsGivesSandboxesOfTheirOwn(t *testing.T) {
+	oldSlots := evalSlots
+	t.Cleanup(func() { evalSlots = oldSlots })
+	if err := initSlots(2, [][]int{{0, 1}, {2, 3}}); err != nil {
+		t.Fatal(err)
+	}
+	sandboxes := make(map[int]bool)
+	for i := 0; i < 2; i++ {
+		slot := <-evalSlots
+		// The slot itself and each of its CPUs has a sandbox.
+		for sandbox := slot.sandbox; sandbox <= slot.sandbox+len(slot.cpus); sandbox++ {
+			if sandboxes[sandbox] {
+				t.Errorf("got sandbox %d used by two slots", sandbox)
+			}
+			sandboxes[sandbox] = true
+		}
+	}
+}
+
+// checkResults checks the results stored for some test cases and groups of the run.
+func (test *judgeTest) checkResults(t *testing.T, wantCases map[int64]storage.SubmissionCaseRun, wantGroups map[int64]storage.SubmissionGroupRun) {
+	caseRuns := caseRunsById(test.store.CaseRuns(testRunId))
+	for id, want := range wantCases {
+		got := caseRuns[id]
+		if got.TimeUsageMs != want.TimeUsageMs || got.Score != want.Score || got.Verdict != want.Verdict {
+			t.Errorf("got result %+v for test case %d, want %+v", got, id, want)
+		}
+	}
+	groupRuns := groupRunsById(test.store.GroupRuns(testRunId))
+	for id, want := range wantGroups {
+		got := groupRuns[id]
+		if got.TimeUsageMs != want.TimeUsageMs || got.Score != want.Score || got.Verdict != want.Verdict {
+			t.Errorf("got result %+v for group %d, want %+v", got, id, want)
+		}
+	}
+}
+
+func TestEvaluateParallel(t *testing.T) {
+	test := newJudgeTest(t, true)
+	test.backend.judge = judgeByName
+	useParallelSlot(t, 2)
+	if err := test.evaluate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if test.backend.evaluations != 2 {
+		t.Errorf("got %d evaluations, want the plan judged in 2 parts", test.backend.evaluations)
+	}
+	// The parts run at the same time, so they must not share a sandbox.
+	if len(test.backend.sandboxes) != 2 || test.backend.sandboxes[0] {
+		t.Errorf("got evaluations in sandboxes %v, want the parts in sandboxes of their own", test.backend.sandboxes)
+	}
+	run := test.run(t)
+	if run.Status != storage.StatusDone || run.Verdict != storage.VerdictWrongAnswer || run.TimeUsageMs != 51 || run.Score != 4 {
+		t.Errorf("got run %+v, want wrong answer using 51 ms with score 4", run)
+	}
+	test.checkResults(t, map[int64]storage.SubmissionCaseRun{
+		21: {TimeUsageMs: 21, Score: 1, Verdict: storage.VerdictAccepted},
+		22: {TimeUsageMs: 22, Score: 1, Verdict: storage.VerdictAccepted},
+		41: {TimeUsageMs: 41, Score: 1, Verdict: storage.VerdictAccepted},
+		42: {TimeUsageMs: 42, Score: 0, Verdict: storage.VerdictWrongAnswer},
+		51: {TimeUsageMs: 51, Score: 1, Verdict: storage.VerdictAccepted},
+	}, map[int64]storage.SubmissionGroupRun{
+		sampleGroupId: {TimeUsageMs: 22, Score: 2, Verdict: storage.VerdictAccepted},
+		group1Id:      {TimeUsageMs: 42, Score: 1, Verdict: storage.VerdictWrongAnswer},
+		group2Id:      {TimeUsageMs: 51, Score: 1, Verdict: storage.VerdictAccepted},
+		secretGroupId: {TimeUsageMs: 51, Score: 2, Verdict: storage.VerdictWrongAnswer},
+		rootGroupId:   {TimeUsageMs: 51, Score: 4, Verdict: storage.VerdictWrongAnswer},
+	})
+	// Each test case and group is reported, together with the compilation.
+	if len(test.progress) != 11 {
+		t.Errorf("got %d progress reports, want 11", len(test.progress))
+	}
+}
+
+func TestEvaluateParallelIgnoresSamples(t *testing.T) {
+	test := newJudgeTest(t, true)
+	root := newTestGroup(rootGroupId, 0, "data")
+	root.IgnoreSample = true
+	test.addTestgroup(t, root)
+	test.backend.judge = func(testcase *apipb.TestCase) *apipb.Result {
+		if testcase.Name == "data/sample/21" {
+			return caseResult(apipb.Verdict_WRONG_ANSWER, 21, 0)
+		}
+		return judgeByName(testcase)
+	}
+	useParallelSlot(t, 2)
+	if err := test.evaluate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if test.backend.evaluations != 2 {
+		t.Errorf("got %d evaluations, want the plan judged in 2 parts", test.backend.evaluations)
+	}
+	test.checkResults(t, nil, map[int64]storage.SubmissionGroupRun{
+		sampleGroupId: {TimeUsageMs: 22, Score: 1, Verdict: storage.VerdictWrongAnswer},
+		secretGroupId: {TimeUsageMs: 51, Score: 2, Verdict: storage.VerdictWrongAnswer},
+		// Only the secret group counts.
+		rootGroupId: {TimeUsageMs: 51, Score: 2, Verdict: storage.VerdictWrongAnswer},
+	})
+}
+
+func TestEvaluateParallelMismatchIsRetried(t *testing.T) {
+	test := newJudgeTest(t, true)
+	test.backend.judge = judgeByName
+	// The evaluator aggregates groups differently than the judgehost expects.
+	test.backend.groupScoreBonus = 1
+	useParallelSlot(t, 2)
+	if err := test.evaluate(); status.Code(err) != codes.Aborted {
+		t.Fatalf("got error %v, want the evaluation to be aborted", err)
+	}
+
+	if test.backend.evaluations != 2 {
+		t.Errorf("got %d evaluations, want only the 2 parts judged", test.backend.evaluations)
+	}
+	if run := test.run(t); run.Status != storage.StatusRunning {
+		t.Errorf("got run with status %q, want it left for the queue to retry", run.Status)
+	}
+	if caseRuns := test.store.CaseRuns(testRunId); len(caseRuns) != 0 {
+		t.Errorf("got results %v of a failed evaluation", caseRuns)
+	}
+}
+
+func TestPrejudgeRejectsOnSamples(t *testing.T) {
+	test := newJudgeTest(t, false)
+	prejudgeSamples = true
+	t.Cleanup(func() { prejudgeSamples = false })
+	version, err := test.store.LoadProblemVersion(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version.RejectOnSampleFailure = true
+	test.store.AddProblemVersion(*version)
+	test.backend.results = []*apipb.Result{
+		caseResult(apipb.Verdict_ACCEPTED, 10, 0),      // test case 21
+		caseResult(apipb.Verdict_WRONG_ANSWER, 10, 0),  // test case 22
+		groupResult(apipb.Verdict_WRONG_ANSWER, 10, 0), // sample group
+	}
+	if err := test.evaluate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if plan := test.backend.plan; plan == nil || plan.RootGroup.Name != "data/sample" {
+		t.Fatalf("got plan %v, want only the sample group to be judged", plan)
+	}
+	run := test.run(t)
+	if run.Status != storage.StatusDone || run.Verdict != storage.VerdictWrongAnswer || run.SampleVerdict != storage.VerdictWrongAnswer {
+		t.Errorf("got run with status %q, verdict %q and sample verdict %q, want it rejected on the samples", run.Status, run.Verdict, run.SampleVerdict)
+	}
+}
+
+func TestFindSampleGroup(t *testing.T) {
+	samples := &apipb.TestGroup{Name: "data/sample"}
+	plan := &apipb.TestGroup{Name: "data", Groups: []*apipb.TestGroup{samples, {Name: "data/secret"}}}
+	sampleGroup := newTestGroup(sampleGroupId, rootGroupId, "data/sample", 21, 22)
+	groups := []*storage.ProblemTestgroup{&sampleGroup}
+	if found := findSampleGroup(groups, plan); found != nil {
+		t.Errorf("found sample group %v of a problem version without samples", found)
+	}
+	sampleGroup.IsSample = true
+	if found := findSampleGroup(groups, plan); found != samples {
+		t.Errorf("got sample group %v, want %v", found, samples)
+	}
+}
+
+func TestEvaluateStoresFeedback(t *testing.T) {
+	test := newJudgeTest(t, false)
+	outputDir := t.TempDir()
+	for name, contents := range map[string]string{
+		"stderr":                    "debug output\n",
+		"output":                    "2\n",
+		"feedback/judgemessage.txt": "expected 1\n",
+		"feedback/teammessage.txt":  "",
+		"accepted/judgemessage.txt": "",
+	} {
+		path := filepath.Join(outputDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wrongAnswer := caseResult(apipb.Verdict_WRONG_ANSWER, 20, 0) // test case 22
+	wrongAnswer.FeedbackDir = filepath.Join(outputDir, "feedback")
+	wrongAnswer.StderrPath = filepath.Join(outputDir, "stderr")
+	wrongAnswer.OutputPath = filepath.Join(outputDir, "output")
+	accepted := caseResult(apipb.Verdict_ACCEPTED, 10, 0) // test case 21
+	accepted.FeedbackDir = filepath.Join(outputDir, "accepted")
+	test.backend.results = []*apipb.Result{
+		accepted,
+		wrongAnswer,
+		groupResult(apipb.Verdict_WRONG_ANSWER, 20, 0), // sample group
+		caseResult(apipb.Verdict_ACCEPTED, 30, 0),      // test case 41
+		caseResult(apipb.Verdict_ACCEPTED, 40, 0),      // test case 42
+		groupResult(apipb.Verdict_ACCEPTED, 40, 0),     // group 1
+		caseResult(apipb.Verdict_ACCEPTED, 50, 0),      // test case 51
+		groupResult(apipb.Verdict_ACCEPTED, 50, 0),     // group 2
+		groupResult(apipb.Verdict_ACCEPTED, 50, 0),     // secret group
+		groupResult(apipb.Verdict_WRONG_ANSWER, 50, 0), // root group
+	}
+	if err := test.evaluate(); err != nil {
+		t.Fatalf("evaluate failed: %v", err)
+	}
+
+	caseRuns := caseRunsById(test.store.CaseRuns(testRunId))
+	if feedback := caseRuns[21].Feedback; feedback != nil {
+		t.Errorf("got feedback %+v for a test case without any", feedback)
+	}
+	feedback := caseRuns[22].Feedback
+	if feedback == nil {
+		t.Fatal("feedback of the wrong answer was not stored")
+	}
+	if feedback.SubmissionCaseRunId != caseRuns[22].SubmissionCaseRunId {
+		t.Errorf("got feedback of test case run %d, want %d", feedback.SubmissionCaseRunId, caseRuns[22].SubmissionCaseRunId)
+	}
+	want := storage.SubmissionCaseFeedback{
+		SubmissionCaseRunId: caseRuns[22].SubmissionCaseRunId,
+		JudgeMessage:        "expected 1\n",
+		Stderr:              "debug output\n",
+		FirstMismatch:       "@@ line 1 @@\n-1\n+2\n",
+	}
+	if *feedback != want {
+		t.Errorf("got feedback %+v, want %+v", *feedback, want)
+	}
+}
+
+func TestTestRunReportsOutputAndMemory(t *testing.T) {
+	test := newJudgeTest(t, false)
+	outputDir := t.TempDir()
+	stdout := strings.Repeat("x", maxTestRunOutputBytes+1)
+	if err := ioutil.WriteFile(filepath.Join(outputDir, "stdout"), []byte(stdout), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(outputDir, "stderr"), []byte("debug output\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	result := caseResult(apipb.Verdict_MEMORY_LIMIT_EXCEEDED, 10, 0)
+	result.MemoryUsageKb = 300_000
+	result.OutputPath = filepath.Join(outputDir, "stdout")
+	result.StderrPath = filepath.Join(outputDir, "stderr")
+	test.backend.results = []*apipb.Result{result, groupResult(apipb.Verdict_ACCEPTED, 10, 0)}
+	response, err := testRun(context.Background(), test.store, &hostpb.TestRunRequest{
+		ProblemVersionId: 1,
+		Language:         "cpp",
+		Files:            map[string][]byte{"main.cpp": []byte("int main() {}")},
+		Stdin:            []byte("1\n"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Verdict != string(storage.VerdictMemoryLimitExceeded) || response.TimeUsageMs != 10 || response.MemoryUsageKb != 300_000 {
+		t.Errorf("got verdict %q using %d ms and %d kB, want memory limit exceeded using 10 ms and 300000 kB", response.Verdict, response.TimeUsageMs, response.MemoryUsageKb)
+	}
+	if string(response.Stdout) != stdout[:maxTestRunOutputBytes] {
+		t.Errorf("got %d bytes of stdout, want it truncated to %d bytes", len(response.Stdout), maxTestRunOutputBytes)
+	}
+	if string(response.Stderr) != "debug output\n" {
+		t.Errorf("got stderr %q, want %q", response.Stderr, "debug output\n")
+	}
+}
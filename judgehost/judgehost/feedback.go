@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/google/logger"
+	apipb "github.com/jsannemo/omogenexec/api"
+	"github.com/jsannemo/omogenhost/storage"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// maxExcerptBytes bounds how much of each feedback file is stored.
+	maxExcerptBytes = 4096
+	// maxMismatchLineBytes bounds how much of each line of a mismatch is stored.
+	maxMismatchLineBytes = 256
+	// maxScannedLineBytes is the longest output line compared when looking for a mismatch.
+	maxScannedLineBytes = 1 << 20
+)
+
+// sanitizeExcerpt makes program output storable as text, since it may be binary garbage.
+func sanitizeExcerpt(excerpt string) string {
+	return strings.ReplaceAll(strings.ToValidUTF8(excerpt, "�"), "\x00", "�")
+}
+
+func truncateExcerpt(excerpt string, limit int) string {
+	if len(excerpt) <= limit {
+		return sanitizeExcerpt(excerpt)
+	}
+	return sanitizeExcerpt(excerpt[:limit]) + "\n[truncated]"
+}
+
+// readExcerpt reads the beginning of a file, returning an empty excerpt if the file doesn't exist.
+func readExcerpt(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(file, maxExcerptBytes+1))
+	if err != nil {
+		return "", err
+	}
+	return truncateExcerpt(string(data), maxExcerptBytes), nil
+}
+
+// firstMismatch describes the first line where the output of a program differs from the answer, ignoring trailing
+// whitespace. An empty description is returned if no such line is found.
+func firstMismatch(outputPath string, answerPath string) (string, error) {
+	if outputPath == "" {
+		return "", nil
+	}
+	output, err := os.Open(outputPath)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer output.Close()
+	answer, err := os.Open(answerPath)
+	if err != nil {
+		return "", err
+	}
+	defer answer.Close()
+
+	outputLines := bufio.NewScanner(output)
+	outputLines.Buffer(nil, maxScannedLineBytes)
+	answerLines := bufio.NewScanner(answer)
+	answerLines.Buffer(nil, maxScannedLineBytes)
+	for line := 1; ; line++ {
+		hasOutput := outputLines.Scan()
+		hasAnswer := answerLines.Scan()
+		if !hasOutput && !hasAnswer {
+			break
+		}
+		got := strings.TrimRight(outputLines.Text(), " \t\r")
+		expected := strings.TrimRight(answerLines.Text(), " \t\r")
+		if hasOutput && hasAnswer && got == expected {
+			continue
+		}
+		var diff strings.Builder
+		fmt.Fprintf(&diff, "@@ line %d @@\n", line)
+		if hasAnswer {
+			fmt.Fprintf(&diff, "-%s\n", truncateExcerpt(expected, maxMismatchLineBytes))
+		} else {
+			diff.WriteString("(end of answer)\n")
+		}
+		if hasOutput {
+			fmt.Fprintf(&diff, "+%s\n", truncateExcerpt(got, maxMismatchLineBytes))
+		} else {
+			diff.WriteString("(end of output)\n")
+		}
+		return diff.String(), nil
+	}
+	// Scanning also stops at lines too long to compare, which are not worth reporting.
+	return "", nil
+}
+
+// caseFeedback collects the validator feedback and the excerpts of the program output of a judged test case.
+func caseFeedback(result *apipb.Result, verdict storage.Verdict, answerPath string) (*storage.SubmissionCaseFeedback, error) {
+	feedback := &storage.SubmissionCaseFeedback{}
+	var err error
+	if result.FeedbackDir != "" {
+		if feedback.JudgeMessage, err = readExcerpt(filepath.Join(result.FeedbackDir, "judgemessage.txt")); err != nil {
+			return nil, fmt.Errorf("failed reading judge message: %v", err)
+		}
+		if feedback.TeamMessage, err = readExcerpt(filepath.Join(result.FeedbackDir, "teammessage.txt")); err != nil {
+			return nil, fmt.Errorf("failed reading team message: %v", err)
+		}
+	}
+	if feedback.Stderr, err = readExcerpt(result.StderrPath); err != nil {
+		return nil, fmt.Errorf("failed reading stderr: %v", err)
+	}
+	if verdict == storage.VerdictWrongAnswer {
+		if feedback.FirstMismatch, err = firstMismatch(result.OutputPath, answerPath); err != nil {
+			return nil, fmt.Errorf("failed comparing output: %v", err)
+		}
+	}
+	if feedback.JudgeMessage == "" && feedback.TeamMessage == "" && feedback.Stderr == "" && feedback.FirstMismatch == "" {
+		return nil, nil
+	}
+	return feedback, nil
+}
+
+// collectCaseFeedback returns the feedback of a judged test case, or nil if there is none.
+// Feedback is only an aid for debugging verdicts, so failing to collect it does not fail the run.
+func collectCaseFeedback(result *apipb.Result, verdict storage.Verdict, testcase storage.ProblemTestcase) *storage.SubmissionCaseFeedback {
+	answerPath, _ := findPath(testcase.OutputFileHash)
+	feedback, err := caseFeedback(result, verdict, answerPath)
+	if err != nil {
+		logger.Warningf("failed collecting feedback of test case %d: %v", testcase.ProblemTestcaseId, err)
+		return nil
+	}
+	return feedback
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/BurntSushi/toml"
 	"github.com/google/logger"
@@ -9,38 +10,130 @@ import (
 	apipb "github.com/jsannemo/omogenhost/judgehost/api"
 	"github.com/jsannemo/omogenhost/storage"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"io/ioutil"
 	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 )
 
-type dbConfig struct {
+type hostConfig struct {
 	Server string
 	Port   int
+	// Advertise is the address the queue should use to reach this host, if different from Server:Port.
+	Advertise string
+	// Slots is the number of runs the host judges at the same time.
+	Slots int
+	// SlotCpus optionally assigns the CPUs each slot may use.
+	SlotCpus [][]int `toml:"slot_cpus"`
+	// ParallelCases makes the host judge the test cases of a run in parallel on the CPUs of its slot, for groups that
+	// don't break off judging on rejection. It needs SlotCpus.
+	ParallelCases bool `toml:"parallel_cases"`
+	// PrejudgeSamples makes the host judge runs on the samples alone first, to give a quick sample verdict.
+	PrejudgeSamples bool `toml:"prejudge_samples"`
+	// ResultBatchSize is how many test case results are written to the database at a time.
+	ResultBatchSize int `toml:"result_batch_size"`
+	// ResultFlushMs is the longest time results are held back before they are written to the database.
+	ResultFlushMs int `toml:"result_flush_ms"`
 }
 
-type hostConfig struct {
+type queueConfig struct {
 	Server string
 	Port   int
 }
 
 type config struct {
-	Database  dbConfig
+	Database  storage.Config
 	Judgehost hostConfig
+	Queue     queueConfig
 }
 
 type JudgehostServer struct {
+	store storage.Store
+	// leaseOwner identifies this judgehost in the leases it takes on runs.
+	leaseOwner string
 }
 
-func (j *JudgehostServer) Evaluate(_ context.Context, request *apipb.EvaluateRequest) (*apipb.EvaluateResponse, error) {
+func (j *JudgehostServer) Evaluate(ctx context.Context, request *apipb.EvaluateRequest) (*apipb.EvaluateResponse, error) {
 	runId := request.RunId
 	logger.Infof("Received run %d", runId)
-	err := evaluate(runId)
-	return &apipb.EvaluateResponse{}, err
+	err := evaluate(ctx, j.store, runId, j.leaseOwner, func(*apipb.EvaluateProgress) {})
+	if jerr := asJudgeError(err); jerr != nil {
+		return &apipb.EvaluateResponse{JudgeError: jerr}, nil
+	}
+	return &apipb.EvaluateResponse{}, contextStatus(err)
+}
+
+// contextStatus converts an error of a request's context to the matching gRPC status, which gRPC would otherwise
+// report as Unknown. Other errors are returned as they are.
+func contextStatus(err error) error {
+	if errors.Is(err, context.Canceled) {
+		return status.Error(codes.Canceled, err.Error())
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	return err
+}
+
+// asJudgeError converts an error of a run that was marked as a judging error to its API form, or nil for other errors.
+func asJudgeError(err error) *apipb.JudgeError {
+	var jerr *judgeError
+	if !errors.As(err, &jerr) {
+		return nil
+	}
+	return &apipb.JudgeError{Reason: jerr.reason, Message: jerr.message}
+}
+
+func (j *JudgehostServer) EvaluateStream(request *apipb.EvaluateRequest, stream apipb.JudgehostService_EvaluateStreamServer) error {
+	runId := request.RunId
+	logger.Infof("Received streamed run %d", runId)
+	// Results of aborted evaluations may still be reported after we returned, when the stream can no longer be used.
+	var streamMutex sync.Mutex
+	finished := false
+	report := func(progress *apipb.EvaluateProgress) {
+		streamMutex.Lock()
+		defer streamMutex.Unlock()
+		if finished {
+			return
+		}
+		if err := stream.Send(progress); err != nil {
+			logger.Warningf("failed sending progress of run %d: %v", runId, err)
+		}
+	}
+	err := evaluate(stream.Context(), j.store, runId, j.leaseOwner, report)
+	if jerr := asJudgeError(err); jerr != nil {
+		report(&apipb.EvaluateProgress{Progress: &apipb.EvaluateProgress_JudgeError{JudgeError: jerr}})
+		err = nil
+	}
+	streamMutex.Lock()
+	finished = true
+	streamMutex.Unlock()
+	return contextStatus(err)
+}
+
+func (j *JudgehostServer) Cancel(_ context.Context, request *apipb.CancelRequest) (*apipb.CancelResponse, error) {
+	logger.Infof("Cancelling run %d", request.RunId)
+	return &apipb.CancelResponse{Cancelled: activeRuns.cancel(request.RunId)}, nil
+}
+
+func (j *JudgehostServer) TestRun(ctx context.Context, request *apipb.TestRunRequest) (*apipb.TestRunResponse, error) {
+	logger.Infof("Received test run on problem version %d", request.ProblemVersionId)
+	response, err := testRun(ctx, j.store, request)
+	return response, contextStatus(err)
 }
 
 func main() {
 	defer logger.Init("localjudge", true, false, ioutil.Discard).Close()
 	eval.InitLanguages()
+	if len(os.Args) == 2 && os.Args[1] == workerArg {
+		runWorker()
+		return
+	}
 	data, err := ioutil.ReadFile("/etc/omogen/judgehost.toml")
 	if err != nil {
 		panic(err)
@@ -49,8 +142,23 @@ func main() {
 	if _, err := toml.Decode(string(data), &conf); err != nil {
 		panic(err)
 	}
-	connStr := fmt.Sprintf("postgres://omogenjudge:omogenjudge@%s:%d/omogenjudge", conf.Database.Server, conf.Database.Port)
-	if err := storage.Init(connStr); err != nil {
+	if err := initSlots(conf.Judgehost.Slots, conf.Judgehost.SlotCpus); err != nil {
+		panic(err)
+	}
+	prejudgeSamples = conf.Judgehost.PrejudgeSamples
+	parallelCases = conf.Judgehost.ParallelCases
+	if parallelCases && len(conf.Judgehost.SlotCpus) == 0 {
+		logger.Warningf("parallel_cases needs slot_cpus; judging test cases one at a time")
+		parallelCases = false
+	}
+	if conf.Judgehost.ResultBatchSize > 0 {
+		resultBatchSize = conf.Judgehost.ResultBatchSize
+	}
+	if conf.Judgehost.ResultFlushMs > 0 {
+		resultFlushInterval = time.Duration(conf.Judgehost.ResultFlushMs) * time.Millisecond
+	}
+	store, err := storage.NewGormStore(conf.Database)
+	if err != nil {
 		panic(err)
 	}
 	lis, err := net.Listen("tcp", fmt.Sprintf("%s:%d", conf.Judgehost.Server, conf.Judgehost.Port))
@@ -62,8 +170,33 @@ func main() {
 		logger.Fatalf("failed to create server: %v", err)
 	}
 
-	judgehostServer := &JudgehostServer{}
+	hostname, err := os.Hostname()
+	if err != nil {
+		logger.Fatalf("failed to get hostname: %v", err)
+	}
+	judgehostServer := &JudgehostServer{
+		store:      store,
+		leaseOwner: fmt.Sprintf("%s:%d", hostname, conf.Judgehost.Port),
+	}
 	apipb.RegisterJudgehostServiceServer(grpcServer, judgehostServer)
+
+	if conf.Queue.Port != 0 {
+		address := conf.Judgehost.Advertise
+		if address == "" {
+			address = fmt.Sprintf("%s:%d", conf.Judgehost.Server, conf.Judgehost.Port)
+		}
+		registration := newQueueRegistration(fmt.Sprintf("%s:%d", conf.Queue.Server, conf.Queue.Port), address, judgehostServer.leaseOwner, cap(evalSlots))
+		go registration.run()
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-signals
+			logger.Infof("Draining judgehost before shutting down")
+			registration.drain()
+			grpcServer.GracefulStop()
+		}()
+	}
 	if err := grpcServer.Serve(lis); err != nil {
 		logger.Fatalf("could not listen: %v", err)
 	}
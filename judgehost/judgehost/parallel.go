@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	apipb "github.com/jsannemo/omogenexec/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"math"
+	"path"
+	"path/filepath"
+	"sync"
+)
+
+// parallelCases is whether the test cases of a run are judged in parallel on the CPUs of its slot, where the plan
+// allows it.
+var parallelCases bool
+
+// verdictSeverity orders the verdicts of test cases for groups that report their worst error.
+var verdictSeverity = map[apipb.Verdict]int{
+	apipb.Verdict_ACCEPTED:              0,
+	apipb.Verdict_WRONG_ANSWER:          1,
+	apipb.Verdict_TIME_LIMIT_EXCEEDED:   2,
+	apipb.Verdict_RUN_TIME_ERROR:        3,
+	apipb.Verdict_MEMORY_LIMIT_EXCEEDED: 4,
+	apipb.Verdict_OUTPUT_LIMIT_EXCEEDED: 5,
+	apipb.Verdict_JUDGE_ERROR:           6,
+}
+
+// splittable is whether the test cases of a group can be judged in parallel. This needs the group to be judged
+// completely, and its result to be aggregated from those of its test cases and subgroups by the verdict and scoring
+// mode. Subgroups are only splittable if their parent is.
+func splittable(group *apipb.TestGroup) bool {
+	return !group.BreakOnFail && !group.CustomGrading
+}
+
+// aggregateGroup computes the result of a group that was judged completely from the results of its test cases and
+// subgroups, in the order they were judged, leaving out those that are ignoredInGroup. It returns false if the group
+// uses a mode that can't be aggregated.
+func aggregateGroup(group *apipb.TestGroup, results []*apipb.Result) (*apipb.Result, bool) {
+	if len(results) == 0 {
+		return nil, false
+	}
+	aggregate := &apipb.Result{Type: apipb.ResultType_TEST_GROUP, Verdict: apipb.Verdict_ACCEPTED}
+	anyAccepted := false
+	firstError := apipb.Verdict_ACCEPTED
+	worstError := apipb.Verdict_ACCEPTED
+	scoreSum := 0.0
+	minScore, maxScore := math.Inf(1), math.Inf(-1)
+	for _, result := range results {
+		severity, known := verdictSeverity[result.Verdict]
+		if !known {
+			return nil, false
+		}
+		if result.Verdict == apipb.Verdict_ACCEPTED {
+			anyAccepted = true
+		} else if firstError == apipb.Verdict_ACCEPTED {
+			firstError = result.Verdict
+		}
+		if severity > verdictSeverity[worstError] {
+			worstError = result.Verdict
+		}
+		if result.TimeUsageMs > aggregate.TimeUsageMs {
+			aggregate.TimeUsageMs = result.TimeUsageMs
+		}
+		scoreSum += result.Score
+		minScore = math.Min(minScore, result.Score)
+		maxScore = math.Max(maxScore, result.Score)
+	}
+
+	switch group.VerdictMode {
+	case apipb.VerdictMode_WORST_ERROR:
+		aggregate.Verdict = worstError
+	case apipb.VerdictMode_FIRST_ERROR:
+		aggregate.Verdict = firstError
+	case apipb.VerdictMode_ALWAYS_ACCEPT:
+		aggregate.Verdict = apipb.Verdict_ACCEPTED
+	default:
+		return nil, false
+	}
+	if group.AcceptIfAnyAccepted && anyAccepted {
+		aggregate.Verdict = apipb.Verdict_ACCEPTED
+	}
+	switch group.ScoringMode {
+	case apipb.ScoringMode_SUM:
+		aggregate.Score = scoreSum
+	case apipb.ScoringMode_AVG:
+		aggregate.Score = scoreSum / float64(len(results))
+	case apipb.ScoringMode_MIN:
+		aggregate.Score = minScore
+	case apipb.ScoringMode_MAX:
+		aggregate.Score = maxScore
+	default:
+		return nil, false
+	}
+	return aggregate, true
+}
+
+// ignoredInGroup is whether the result of a test case or subgroup doesn't count towards the result of the group, which
+// is the case for the sample group of a group that ignores it. Like the evaluator, this finds the sample group by name.
+func ignoredInGroup(group *apipb.TestGroup, item judgedItem) bool {
+	return group.IgnoreSample && item.group != nil && path.Base(item.group.Name) == "sample"
+}
+
+func sameResult(a, b *apipb.Result) bool {
+	return a.Type == b.Type && a.Verdict == b.Verdict && a.TimeUsageMs == b.TimeUsageMs && math.Abs(a.Score-b.Score) < 1e-9
+}
+
+// planPart is one of the parts a plan is split into to be judged in parallel. Its groups are copies of the splittable
+// groups of the plan, holding some of their test cases, and whole unsplittable groups of the plan.
+type planPart struct {
+	root *apipb.TestGroup
+	// splitFrom maps the copies of splittable groups to the groups of the plan they were copied from.
+	splitFrom map[*apipb.TestGroup]*apipb.TestGroup
+	results   []*apipb.Result
+	// caseResults and groupResults are the results of the part, by test case and group of the part.
+	caseResults  map[*apipb.TestCase]*apipb.Result
+	groupResults map[*apipb.TestGroup]*apipb.Result
+}
+
+// splitPlan splits the test cases of a plan into at most n parts, or returns nil if the plan can't be split in two.
+func splitPlan(plan *apipb.EvaluationPlan, n int) []*planPart {
+	if !splittable(plan.RootGroup) || n < 2 {
+		return nil
+	}
+	parts := make([]*planPart, n)
+	for i := range parts {
+		parts[i] = &planPart{splitFrom: make(map[*apipb.TestGroup]*apipb.TestGroup)}
+	}
+	next := 0
+	var nonEmpty []*planPart
+	for i, root := range splitGroup(plan.RootGroup, parts, &next) {
+		if root != nil {
+			parts[i].root = root
+			nonEmpty = append(nonEmpty, parts[i])
+		}
+	}
+	if len(nonEmpty) < 2 {
+		return nil
+	}
+	return nonEmpty
+}
+
+// splitGroup copies a splittable group into each part, dealing out its test cases and its unsplittable subgroups over
+// the parts in turn. Copies that get no test cases are left out as nil.
+func splitGroup(group *apipb.TestGroup, parts []*planPart, next *int) []*apipb.TestGroup {
+	copies := make([]*apipb.TestGroup, len(parts))
+	for i := range copies {
+		copies[i] = &apipb.TestGroup{
+			Name:                 group.Name,
+			AcceptScore:          group.AcceptScore,
+			RejectScore:          group.RejectScore,
+			OutputValidatorFlags: group.OutputValidatorFlags,
+			BreakOnFail:          group.BreakOnFail,
+			AcceptIfAnyAccepted:  group.AcceptIfAnyAccepted,
+			IgnoreSample:         group.IgnoreSample,
+			ScoringMode:          group.ScoringMode,
+			VerdictMode:          group.VerdictMode,
+			CustomGrading:        group.CustomGrading,
+			GraderFlags:          group.GraderFlags,
+		}
+	}
+	deal := func() int {
+		i := *next % len(parts)
+		*next++
+		return i
+	}
+	for _, item := range judgingOrder(group) {
+		switch {
+		case item.testcase != nil:
+			i := deal()
+			copies[i].Cases = append(copies[i].Cases, item.testcase)
+		case splittable(item.group):
+			for i, subgroup := range splitGroup(item.group, parts, next) {
+				if subgroup != nil {
+					copies[i].Groups = append(copies[i].Groups, subgroup)
+				}
+			}
+		default:
+			i := deal()
+			copies[i].Groups = append(copies[i].Groups, item.group)
+		}
+	}
+	for i, groupCopy := range copies {
+		if len(groupCopy.Cases) == 0 && len(groupCopy.Groups) == 0 {
+			copies[i] = nil
+			continue
+		}
+		parts[i].splitFrom[groupCopy] = group
+	}
+	return copies
+}
+
+// attribute records the results of the part under its test cases and groups, following the order the evaluator
+// judges the part in. It returns false if the results don't fit the part.
+func (p *planPart) attribute() bool {
+	p.caseResults = make(map[*apipb.TestCase]*apipb.Result)
+	p.groupResults = make(map[*apipb.TestGroup]*apipb.Result)
+	next := 0
+	return p.attributeGroup(p.root, &next) && next == len(p.results)
+}
+
+// attributeGroup records the results of a group starting at results[*next]. Like planWalker, a group result that
+// comes before all test cases of the group were judged is taken to mean that the group broke off judging.
+func (p *planPart) attributeGroup(group *apipb.TestGroup, next *int) bool {
+	for _, item := range judgingOrder(group) {
+		if *next == len(p.results) {
+			return false
+		}
+		if item.group != nil {
+			if !p.attributeGroup(item.group, next) {
+				return false
+			}
+			continue
+		}
+		if p.results[*next].Type != apipb.ResultType_TEST_CASE {
+			break
+		}
+		p.caseResults[item.testcase] = p.results[*next]
+		*next++
+	}
+	if *next == len(p.results) || p.results[*next].Type != apipb.ResultType_TEST_GROUP {
+		return false
+	}
+	p.groupResults[group] = p.results[*next]
+	*next++
+	return true
+}
+
+// checkAggregation checks that aggregateGroup computes the same results for the split groups of the part as the
+// evaluator did, so that it can be trusted with the results of the whole groups.
+func (p *planPart) checkAggregation() error {
+	for groupCopy := range p.splitFrom {
+		var results []*apipb.Result
+		for _, item := range judgingOrder(groupCopy) {
+			var result *apipb.Result
+			if item.testcase != nil {
+				result = p.caseResults[item.testcase]
+			} else {
+				result = p.groupResults[item.group]
+			}
+			if result == nil {
+				return fmt.Errorf("group %s was not judged completely", groupCopy.Name)
+			}
+			if !ignoredInGroup(groupCopy, item) {
+				results = append(results, result)
+			}
+		}
+		aggregate, ok := aggregateGroup(groupCopy, results)
+		if !ok {
+			return fmt.Errorf("can't aggregate the results of group %s", groupCopy.Name)
+		}
+		if reported := p.groupResults[groupCopy]; !sameResult(aggregate, reported) {
+			return fmt.Errorf("group %s was reported as %v, but aggregates to %v", groupCopy.Name, reported, aggregate)
+		}
+	}
+	return nil
+}
+
+// mergeParts puts the results of the parts of a plan together into the results the evaluator would have reported for
+// the whole plan, in the same order.
+func mergeParts(plan *apipb.EvaluationPlan, parts []*planPart) ([]*apipb.Result, error) {
+	caseResults := make(map[*apipb.TestCase]*apipb.Result)
+	groupResults := make(map[*apipb.TestGroup]*apipb.Result)
+	for _, part := range parts {
+		for testcase, result := range part.caseResults {
+			caseResults[testcase] = result
+		}
+		for group, result := range part.groupResults {
+			if _, split := part.splitFrom[group]; !split {
+				groupResults[group] = result
+			}
+		}
+	}
+	var merged []*apipb.Result
+	// mergeGroup adds the results of a group to merged, returning the result of the group. The results of split groups
+	// are aggregated from those of their test cases and subgroups, while unsplit groups were judged by a single part.
+	var mergeGroup func(group *apipb.TestGroup, split bool) (*apipb.Result, error)
+	mergeGroup = func(group *apipb.TestGroup, split bool) (*apipb.Result, error) {
+		var results []*apipb.Result
+		for _, item := range judgingOrder(group) {
+			var result *apipb.Result
+			if item.testcase != nil {
+				result = caseResults[item.testcase]
+				if result != nil {
+					merged = append(merged, result)
+				}
+			} else {
+				var err error
+				if result, err = mergeGroup(item.group, split && splittable(item.group)); err != nil {
+					return nil, err
+				}
+			}
+			if result == nil {
+				if split {
+					return nil, fmt.Errorf("group %s was not judged completely", group.Name)
+				}
+				continue
+			}
+			if !ignoredInGroup(group, item) {
+				results = append(results, result)
+			}
+		}
+		if !split {
+			result := groupResults[group]
+			if result != nil {
+				merged = append(merged, result)
+			}
+			return result, nil
+		}
+		result, ok := aggregateGroup(group, results)
+		if !ok {
+			return nil, fmt.Errorf("can't aggregate the results of group %s", group.Name)
+		}
+		merged = append(merged, result)
+		return result, nil
+	}
+	if _, err := mergeGroup(plan.RootGroup, true); err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
+
+// judgePlan evaluates a plan like runPlan. If test cases are judged in parallel, the plan is split into a part for
+// each CPU of the slot, which are judged at the same time. Their results are passed to handle once all parts are
+// judged, in the order a single evaluation would have reported them.
+// If the parts fail, or their results can't be put together, an Aborted error is returned so that the run can be
+// judged again.
+func (s *evalSlot) judgePlan(ctx context.Context, root string, plan *apipb.EvaluationPlan, handle func(*apipb.Result)) error {
+	if !parallelCases {
+		return s.runPlan(ctx, root, plan, handle)
+	}
+	parts := splitPlan(plan, len(s.cpus))
+	if parts == nil {
+		return s.runPlan(ctx, root, plan, handle)
+	}
+	results, err := s.runParts(ctx, root, plan, parts)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return status.Errorf(codes.Aborted, "failed judging plan in parallel: %v", err)
+	}
+	for _, result := range results {
+		handle(result)
+	}
+	return nil
+}
+
+// runParts judges the parts of a plan on one CPU of the slot each, returning the merged results.
+func (s *evalSlot) runParts(ctx context.Context, root string, plan *apipb.EvaluationPlan, parts []*planPart) ([]*apipb.Result, error) {
+	partCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var errMutex sync.Mutex
+	var firstErr error
+	var wait sync.WaitGroup
+	for i, part := range parts {
+		wait.Add(1)
+		go func(i int, part *planPart) {
+			defer wait.Done()
+			cpuSlot := &evalSlot{id: s.id, cpus: []int{s.cpus[i]}, sandbox: s.sandbox + 1 + i}
+			err := cpuSlot.runPlan(partCtx, filepath.Join(root, fmt.Sprintf("part%d", i)), groupPlan(plan, part.root), func(result *apipb.Result) {
+				part.results = append(part.results, result)
+			})
+			if err != nil {
+				errMutex.Lock()
+				defer errMutex.Unlock()
+				// The other parts fail too once they are cancelled, so only the first error is the cause.
+				if firstErr == nil {
+					firstErr = fmt.Errorf("failed judging part %d: %v", i, err)
+				}
+				// The results of the other parts are of no use without this one.
+				cancel()
+			}
+		}(i, part)
+	}
+	wait.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	for i, part := range parts {
+		if !part.attribute() {
+			return nil, fmt.Errorf("results of part %d don't fit its plan", i)
+		}
+		if err := part.checkAggregation(); err != nil {
+			return nil, fmt.Errorf("part %d: %v", i, err)
+		}
+	}
+	return mergeParts(plan, parts)
+}
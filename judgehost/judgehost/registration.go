@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"github.com/google/logger"
+	queuepb "github.com/jsannemo/omogenhost/queue/api"
+	"google.golang.org/grpc"
+	"sort"
+	"time"
+)
+
+// registrationRetry is how long to wait before retrying a failed registration with the queue.
+const registrationRetry = 10 * time.Second
+
+// defaultHeartbeatInterval is how often heartbeats are sent if the queue asks for an invalid interval.
+const defaultHeartbeatInterval = 10 * time.Second
+
+// queueRegistration announces this judgehost to the queue and keeps it in the queue's rotation.
+type queueRegistration struct {
+	client  queuepb.QueueServiceClient
+	address string
+	// hostId is the lease owner of the host.
+	hostId string
+	slots  int
+	stop   chan struct{}
+}
+
+func newQueueRegistration(queueAddress string, address string, hostId string, slots int) *queueRegistration {
+	conn, err := grpc.Dial(queueAddress, grpc.WithInsecure())
+	if err != nil {
+		logger.Fatalf("fail to dial queue: %v", err)
+	}
+	return &queueRegistration{
+		client:  queuepb.NewQueueServiceClient(conn),
+		address: address,
+		hostId:  hostId,
+		slots:   slots,
+		stop:    make(chan struct{}),
+	}
+}
+
+func supportedLanguages() []string {
+	var languages []string
+	for lang := range langMap {
+		languages = append(languages, lang)
+	}
+	sort.Strings(languages)
+	return languages
+}
+
+// register blocks until the queue accepted the registration, and returns the requested heartbeat interval.
+func (r *queueRegistration) register() time.Duration {
+	req := &queuepb.RegisterRequest{
+		Address:   r.address,
+		Slots:     int32(r.slots),
+		Languages: supportedLanguages(),
+		HostId:    r.hostId,
+	}
+	for {
+		res, err := r.client.Register(context.Background(), req)
+		if err == nil {
+			logger.Infof("Registered with queue as %s", r.address)
+			interval := time.Duration(res.HeartbeatIntervalMs) * time.Millisecond
+			if interval <= 0 {
+				logger.Warningf("Queue asked for heartbeats every %v; sending them every %v instead", interval, defaultHeartbeatInterval)
+				interval = defaultHeartbeatInterval
+			}
+			return interval
+		}
+		logger.Warningf("Failed registering with queue; retrying in %v: %v", registrationRetry, err)
+		time.Sleep(registrationRetry)
+	}
+}
+
+// run registers with the queue and then sends heartbeats forever, registering again if the queue forgot about us.
+func (r *queueRegistration) run() {
+	interval := r.register()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-time.After(interval):
+		}
+		res, err := r.client.Heartbeat(context.Background(), &queuepb.HeartbeatRequest{Address: r.address})
+		if err != nil {
+			logger.Warningf("Failed sending heartbeat to queue: %v", err)
+			continue
+		}
+		if res.UnknownHost {
+			interval = r.register()
+		}
+	}
+}
+
+// drain stops the heartbeats and asks the queue to stop sending new runs to this judgehost.
+func (r *queueRegistration) drain() {
+	close(r.stop)
+	if _, err := r.client.Drain(context.Background(), &queuepb.DrainRequest{Address: r.address}); err != nil {
+		logger.Warningf("Failed draining from queue: %v", err)
+	}
+}
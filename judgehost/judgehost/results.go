@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"github.com/google/logger"
+	"github.com/jsannemo/omogenhost/storage"
+	"sync"
+	"time"
+)
+
+const (
+	defaultResultBatchSize     = 50
+	defaultResultFlushInterval = time.Second
+)
+
+// resultBatchSize is how many results are buffered before they are written to the database.
+var resultBatchSize = defaultResultBatchSize
+
+// resultFlushInterval is the longest time results are buffered before they are written to the database.
+var resultFlushInterval = defaultResultFlushInterval
+
+// resultWriter buffers the results of a judging attempt of a run and writes them to the database in batches.
+// Results are written when enough of them have been buffered, when they have been buffered for too long and whenever
+// a test group is finished. Progress of the run is published in order as the results are written.
+type resultWriter struct {
+	mu            sync.Mutex
+	store         storage.Store
+	runId         int64
+	leaseOwner    string
+	attemptId     string
+	finished      bool
+	caseRuns      []storage.SubmissionCaseRun
+	groupRuns     []storage.SubmissionGroupRun
+	progress      []storage.RunProgress
+	lastFlush     time.Time
+	err           error
+	stopFlushing  chan struct{}
+	flushStopOnce sync.Once
+}
+
+// newResultWriter starts writing the results of a run, which must be tagged with the given attempt id.
+func newResultWriter(store storage.Store, runId int64, leaseOwner string, attemptId string) *resultWriter {
+	w := &resultWriter{
+		store:        store,
+		runId:        runId,
+		leaseOwner:   leaseOwner,
+		attemptId:    attemptId,
+		lastFlush:    time.Now(),
+		stopFlushing: make(chan struct{}),
+	}
+	go w.flushPeriodically()
+	return w
+}
+
+// flushPeriodically writes results that have been buffered for too long, even if no more results are arriving.
+func (w *resultWriter) flushPeriodically() {
+	ticker := time.NewTicker(resultFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stopFlushing:
+			return
+		case <-ticker.C:
+		}
+		w.mu.Lock()
+		if time.Since(w.lastFlush) >= resultFlushInterval {
+			w.flush()
+		}
+		w.mu.Unlock()
+	}
+}
+
+// addCase buffers the result of a test case, together with the progress to publish once it is written.
+func (w *resultWriter) addCase(caseRun storage.SubmissionCaseRun, progress storage.RunProgress) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.caseRuns = append(w.caseRuns, caseRun)
+	w.progress = append(w.progress, progress)
+	if len(w.caseRuns)+len(w.groupRuns) >= resultBatchSize || time.Since(w.lastFlush) >= resultFlushInterval {
+		w.flush()
+	}
+}
+
+// addGroup writes the result of a test group together with everything buffered before it.
+func (w *resultWriter) addGroup(groupRun storage.SubmissionGroupRun) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.groupRuns = append(w.groupRuns, groupRun)
+	w.flush()
+}
+
+// flush writes the buffered results. The caller must hold w.mu.
+func (w *resultWriter) flush() {
+	if w.err == nil && len(w.caseRuns)+len(w.groupRuns) > 0 {
+		if err := w.store.WriteResults(w.runId, w.leaseOwner, w.caseRuns, w.groupRuns); err != nil {
+			w.err = fmt.Errorf("failed writing results: %v", err)
+		}
+	}
+	// Listeners look the results up once notified, so progress is only published for results that were written.
+	if w.err == nil {
+		if err := w.store.NotifyProgress(w.progress...); err != nil {
+			logger.Warningf("%v", err)
+		}
+	}
+	w.caseRuns = nil
+	w.groupRuns = nil
+	w.progress = nil
+	w.lastFlush = time.Now()
+}
+
+func (w *resultWriter) stop() {
+	w.flushStopOnce.Do(func() { close(w.stopFlushing) })
+}
+
+// finish writes the remaining results and marks the run as done.
+func (w *resultWriter) finish(run *storage.SubmissionRun) error {
+	w.stop()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.flush()
+	if w.err != nil {
+		return w.err
+	}
+	run.AttemptId = w.attemptId
+	if err := w.store.FinishRun(run, w.leaseOwner); err != nil {
+		return err
+	}
+	w.finished = true
+	return nil
+}
+
+// abort removes the results written by the attempt. It does nothing if the run was already finished.
+func (w *resultWriter) abort() {
+	w.stop()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.finished {
+		return
+	}
+	if err := w.store.DiscardResults(w.runId, w.attemptId); err != nil {
+		logger.Warningf("failed discarding results of run %d: %v", w.runId, err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/logger"
+	apipb "github.com/jsannemo/omogenexec/api"
+	"github.com/jsannemo/omogenhost/storage"
+	"path/filepath"
+)
+
+// prejudgeSamples is whether runs are judged on the sample group alone before they are judged on all test data.
+var prejudgeSamples bool
+
+// findSampleGroup returns the group of the plan made from the sample group of a problem version.
+// Nil is returned if the problem version has no samples.
+func findSampleGroup(groups []*storage.ProblemTestgroup, rootGroup *apipb.TestGroup) *apipb.TestGroup {
+	for _, group := range groups {
+		if group.IsSample && len(group.ProblemTestcases) > 0 {
+			return findPlanGroup(rootGroup, group.TestgroupName)
+		}
+	}
+	return nil
+}
+
+// findPlanGroup returns the group of a plan with the given name.
+func findPlanGroup(group *apipb.TestGroup, name string) *apipb.TestGroup {
+	if group.Name == name {
+		return group
+	}
+	for _, subgroup := range group.Groups {
+		if found := findPlanGroup(subgroup, name); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// groupPlan is the evaluation plan that judges only the given group with the settings of a plan.
+func groupPlan(plan *apipb.EvaluationPlan, group *apipb.TestGroup) *apipb.EvaluationPlan {
+	return &apipb.EvaluationPlan{
+		Program:              plan.Program,
+		RootGroup:            group,
+		TimeLimitMs:          plan.TimeLimitMs,
+		MemLimitKb:           plan.MemLimitKb,
+		OutputLimitKb:        plan.OutputLimitKb,
+		ValidatorTimeLimitMs: plan.ValidatorTimeLimitMs,
+		ValidatorMemLimitKb:  plan.ValidatorMemLimitKb,
+		PlanType:             plan.PlanType,
+		Validator:            plan.Validator,
+		ScoringValidator:     plan.ScoringValidator,
+		Grader:               plan.Grader,
+	}
+}
+
+// judgeSamples evaluates the program on the sample group of the plan only, returning the result of the group.
+// A nil result is returned if the problem has no samples.
+func judgeSamples(ctx context.Context, slot *evalSlot, root string, plan *apipb.EvaluationPlan, groups []*storage.ProblemTestgroup) (*apipb.Result, error) {
+	sampleGroup := findSampleGroup(groups, plan.RootGroup)
+	if sampleGroup == nil {
+		return nil, nil
+	}
+	var groupResult *apipb.Result
+	err := slot.runPlan(ctx, root, groupPlan(plan, sampleGroup), func(result *apipb.Result) {
+		if result.Type == apipb.ResultType_TEST_GROUP {
+			groupResult = result
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed sample evaluation: %v", err)
+	}
+	return groupResult, nil
+}
+
+// prejudgeRun judges the run on its samples and publishes the sample verdict on the run.
+// It returns true if the run was rejected on the samples and needs no further judging.
+func prejudgeRun(ctx context.Context, store storage.Store, slot *evalSlot, run *storage.SubmissionRun, leaseOwner string, subRoot string, plan *apipb.EvaluationPlan, groups []*storage.ProblemTestgroup) (bool, error) {
+	result, err := judgeSamples(ctx, slot, filepath.Join(subRoot, "samples"), plan, groups)
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if err != nil {
+		// Prejudging only gives early feedback, so the full evaluation can still judge the run.
+		logger.Warningf("Run %d: %v", run.SubmissionRunId, err)
+		return false, nil
+	}
+	if result == nil {
+		return false, nil
+	}
+	verdict, err := toStorageVerdict(result.Verdict)
+	if err != nil {
+		logger.Warningf("Run %d: ignoring sample result: %v", run.SubmissionRunId, err)
+		return false, nil
+	}
+	if verdict == storage.VerdictJudgeError {
+		logger.Warningf("Run %d: ignoring sample result: evaluator failed judging the samples", run.SubmissionRunId)
+		return false, nil
+	}
+	logger.Infof("Run %d got %s on the samples", run.SubmissionRunId, verdict)
+	run.SampleVerdict = verdict
+	reject := run.ProblemVersion.RejectOnSampleFailure && verdict != storage.VerdictAccepted
+	columns := []string{"SampleVerdict"}
+	if reject {
+		run.Status = storage.StatusDone
+		run.Verdict = verdict
+		run.TimeUsageMs = result.TimeUsageMs
+		run.Score = 0
+		columns = append(columns, "Status", "Verdict", "TimeUsageMs", "Score")
+	}
+	held, err := store.UpdateRun(run, leaseOwner, columns...)
+	if err != nil {
+		return false, fmt.Errorf("failed writing sample results: %v", err)
+	}
+	if !held {
+		return false, errLeaseLost(run.SubmissionRunId)
+	}
+	if err := store.NotifyProgress(storage.RunProgress{
+		RunId:         run.SubmissionRunId,
+		Status:        run.Status,
+		SampleVerdict: run.SampleVerdict,
+	}); err != nil {
+		logger.Warningf("%v", err)
+	}
+	return reject, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	apipb "github.com/jsannemo/omogenexec/api"
+)
+
+// evalSlot is one of the evaluations a judgehost can run at the same time.
+type evalSlot struct {
+	id int
+	// cpus are the CPUs reserved for the slot, or empty if the slot can run anywhere.
+	cpus []int
+	// sandbox is the id of the sandbox the programs of the slot run in. Each slot has a sandbox of its own, followed
+	// by one for each of its CPUs that test cases are judged on in parallel.
+	sandbox int
+}
+
+// evalSlots holds the slots that are currently free.
+var evalSlots chan *evalSlot
+
+// initSlots creates the given number of evaluation slots. If slotCpus is given, it contains the CPUs of each slot.
+func initSlots(slots int, slotCpus [][]int) error {
+	if slots < 1 {
+		slots = 1
+	}
+	if len(slotCpus) != 0 && len(slotCpus) != slots {
+		return fmt.Errorf("got CPUs for %d slots, but have %d slots", len(slotCpus), slots)
+	}
+	evalSlots = make(chan *evalSlot, slots)
+	sandbox := 0
+	for i := 0; i < slots; i++ {
+		slot := &evalSlot{id: i, sandbox: sandbox}
+		if len(slotCpus) != 0 {
+			slot.cpus = slotCpus[i]
+		}
+		sandbox += 1 + len(slot.cpus)
+		evalSlots <- slot
+	}
+	return nil
+}
+
+// acquireSlot waits for a free slot, returning the error of the context if it is done first.
+func acquireSlot(ctx context.Context) (*evalSlot, error) {
+	select {
+	case slot := <-evalSlots:
+		return slot, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// release frees the slot for other evaluations.
+func (s *evalSlot) release() {
+	evalSlots <- s
+}
+
+// runPlan evaluates a plan on the CPUs of the slot, passing each result to handle in the order they are reported.
+// If the context is done, the evaluation is killed and the error of the context is returned. Either way, runPlan
+// returns only once the evaluation has stopped, so the slot and the files of the evaluation are free to reuse.
+func (s *evalSlot) runPlan(ctx context.Context, root string, plan *apipb.EvaluationPlan, handle func(*apipb.Result)) error {
+	results := make(chan *apipb.Result, 1000)
+	handled := make(chan struct{})
+	go func() {
+		for result := range results {
+			handle(result)
+		}
+		close(handled)
+	}()
+	err := backend.Evaluate(ctx, s, root, plan, results)
+	<-handled
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/logger"
+	apipb "github.com/jsannemo/omogenexec/api"
+	"github.com/jsannemo/omogenexec/util"
+	hostpb "github.com/jsannemo/omogenhost/judgehost/api"
+	"github.com/jsannemo/omogenhost/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// maxTestRunOutputBytes bounds how much of the output of a test run is returned.
+const maxTestRunOutputBytes = 64 * 1024
+
+// readOutput reads the beginning of a file written by a program, returning nothing if the file doesn't exist.
+func readOutput(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(io.LimitReader(file, maxTestRunOutputBytes))
+}
+
+// testRun compiles a program and runs it once on the given input with the limits of a problem version.
+// Nothing about the run is stored.
+func testRun(ctx context.Context, store storage.Store, request *hostpb.TestRunRequest) (*hostpb.TestRunResponse, error) {
+	slot, err := acquireSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer slot.release()
+
+	version, err := store.LoadProblemVersion(request.ProblemVersionId)
+	if err != nil {
+		return nil, fmt.Errorf("failed loading problem version: %v", err)
+	}
+	if version.Interactive {
+		return nil, status.Errorf(codes.FailedPrecondition, "test runs are not supported for interactive problems")
+	}
+	program, err := buildProgram(request.Language, request.Files, *version)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid program: %v", err)
+	}
+
+	root := filepath.Join(dataRoot, "testruns", fmt.Sprint(time.Now().UnixNano()))
+	defer os.RemoveAll(root)
+	compile, err := backend.Compile(ctx, slot, program, filepath.Join(root, "compile"))
+	if err != nil {
+		return nil, err
+	}
+	response := &hostpb.TestRunResponse{
+		CompileFinished: &hostpb.CompileFinished{
+			CompileError: compile.CompilerErrors,
+			Success:      compile.Program != nil,
+		},
+	}
+	if compile.Program == nil {
+		return response, nil
+	}
+
+	fb := util.NewFileBase(filepath.Join(root, "data"))
+	fb.OwnerGid = util.OmogenexecGroupId()
+	if err := fb.Mkdir("."); err != nil {
+		return nil, err
+	}
+	if err := fb.WriteFile("input", request.Stdin); err != nil {
+		return nil, err
+	}
+	// The program is checked against an empty answer, but the validation verdict is never reported.
+	if err := fb.WriteFile("answer", nil); err != nil {
+		return nil, err
+	}
+	evalPlan := &apipb.EvaluationPlan{
+		Program:              compile.Program,
+		TimeLimitMs:          int32(version.TimeLimitMs),
+		MemLimitKb:           int32(version.MemoryLimitKb),
+		OutputLimitKb:        int32(version.OutputLimitKb),
+		ValidatorTimeLimitMs: 60_000,
+		ValidatorMemLimitKb:  1_000_000,
+		PlanType:             apipb.EvaluationType_SIMPLE,
+		RootGroup: &apipb.TestGroup{
+			Name: "testrun",
+			Cases: []*apipb.TestCase{{
+				Name:       "input",
+				InputPath:  filepath.Join(root, "data", "input"),
+				OutputPath: filepath.Join(root, "data", "answer"),
+			}},
+			ScoringMode: apipb.ScoringMode_SUM,
+			VerdictMode: apipb.VerdictMode_ALWAYS_ACCEPT,
+		},
+	}
+
+	var caseResult *apipb.Result
+	err = slot.runPlan(ctx, filepath.Join(root, "eval"), evalPlan, func(result *apipb.Result) {
+		if result.Type == apipb.ResultType_TEST_CASE {
+			caseResult = result
+		}
+	})
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed test run: %v", err)
+	}
+	if caseResult == nil {
+		return nil, fmt.Errorf("evaluator reported no result")
+	}
+
+	verdict, err := toStorageVerdict(caseResult.Verdict)
+	if err != nil {
+		return nil, err
+	}
+	// Without a real answer, accepted and wrong answer both just mean that the program ran to completion.
+	if verdict != storage.VerdictAccepted && verdict != storage.VerdictWrongAnswer {
+		response.Verdict = string(verdict)
+	}
+	response.TimeUsageMs = caseResult.TimeUsageMs
+	response.MemoryUsageKb = caseResult.MemoryUsageKb
+	if response.Stdout, err = readOutput(caseResult.OutputPath); err != nil {
+		return nil, fmt.Errorf("failed reading stdout: %v", err)
+	}
+	if response.Stderr, err = readOutput(caseResult.StderrPath); err != nil {
+		return nil, fmt.Errorf("failed reading stderr: %v", err)
+	}
+	logger.Infof("Finished test run of %s program on problem version %d", request.Language, request.ProblemVersionId)
+	return response, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jsannemo/omogenhost/storage"
+	"time"
+)
+
+const (
+	defaultDeadlineFactor = 3.0
+	defaultCompileSeconds = 60
+)
+
+type deadlineConfig struct {
+	// Factor is how many times the time limit each test case may take, to account for validation and overhead.
+	Factor float64
+	// CompileSeconds is the time budget for compiling the submission.
+	CompileSeconds int `toml:"compile_seconds"`
+}
+
+// runDeadline computes how long the judgehost may spend on a run before it is considered stuck.
+func runDeadline(store storage.Store, run storage.SubmissionRun, conf deadlineConfig) (time.Duration, error) {
+	factor := conf.Factor
+	if factor <= 0 {
+		factor = defaultDeadlineFactor
+	}
+	compileSeconds := conf.CompileSeconds
+	if compileSeconds <= 0 {
+		compileSeconds = defaultCompileSeconds
+	}
+	testcases, err := store.CountTestcases(run.ProblemVersionId)
+	if err != nil {
+		return 0, fmt.Errorf("failed counting test cases: %v", err)
+	}
+	evalBudget := time.Duration(float64(run.ProblemVersion.TimeLimitMs*testcases)*factor) * time.Millisecond
+	return evalBudget + time.Duration(compileSeconds)*time.Second, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sync"
+)
+
+// dispatchLine holds the runs of a language that are waiting for a judgehost, in the order they were queued.
+type dispatchLine struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	runs []queuedRun
+}
+
+func newDispatchLine() *dispatchLine {
+	l := &dispatchLine{}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+func (l *dispatchLine) push(run queuedRun) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.runs = append(l.runs, run)
+	l.cond.Signal()
+}
+
+// pop blocks until the line has a run, and removes the first one.
+func (l *dispatchLine) pop() queuedRun {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for len(l.runs) == 0 {
+		l.cond.Wait()
+	}
+	run := l.runs[0]
+	l.runs = l.runs[1:]
+	return run
+}
+
+// dispatcher sends queued runs to judgehosts. Each language has a line of its own, so that runs of a language that no
+// judgehost has a free slot for don't hold up the runs of other languages.
+type dispatcher struct {
+	pool *hostPool
+	// judge judges a run on a host whose slot was reserved for it.
+	judge func(host *judgehost, run queuedRun)
+	mu    sync.Mutex
+	lines map[string]*dispatchLine
+}
+
+func newDispatcher(pool *hostPool, judge func(host *judgehost, run queuedRun)) *dispatcher {
+	return &dispatcher{
+		pool:  pool,
+		judge: judge,
+		lines: make(map[string]*dispatchLine),
+	}
+}
+
+// dispatch adds a run to the line of its language, starting the line if the language had none.
+func (d *dispatcher) dispatch(run queuedRun) {
+	d.mu.Lock()
+	line, found := d.lines[run.language]
+	if !found {
+		line = newDispatchLine()
+		d.lines[run.language] = line
+		go d.serve(run.language, line)
+	}
+	d.mu.Unlock()
+	line.push(run)
+}
+
+// serve sends the runs of a line to judgehosts in order, waiting for a free slot for each of them.
+func (d *dispatcher) serve(language string, line *dispatchLine) {
+	for {
+		run := line.pop()
+		host := d.pool.acquire(language)
+		go d.judge(host, run)
+	}
+}
@@ -6,38 +6,112 @@ import (
 	"github.com/BurntSushi/toml"
 	"github.com/google/logger"
 	apipb "github.com/jsannemo/omogenhost/judgehost/api"
+	queuepb "github.com/jsannemo/omogenhost/queue/api"
 	"github.com/jsannemo/omogenhost/storage"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"io"
 	"io/ioutil"
+	"net"
 	"strconv"
 	"time"
 )
 
-type dbConfig struct {
+type hostConfig struct {
 	Server string
 	Port   int
+	Slots  int
 }
 
-type hostConfig struct {
+// hostConfigs are the judgehosts listed in queue.toml, either as [[judgehosts]] tables or as the single [judgehosts]
+// table of older configurations.
+type hostConfigs []hostConfig
+
+func (c *hostConfigs) UnmarshalTOML(data interface{}) error {
+	switch v := data.(type) {
+	case map[string]interface{}:
+		host, err := toHostConfig(v)
+		if err != nil {
+			return err
+		}
+		*c = hostConfigs{host}
+	case []map[string]interface{}:
+		*c = nil
+		for _, table := range v {
+			host, err := toHostConfig(table)
+			if err != nil {
+				return err
+			}
+			*c = append(*c, host)
+		}
+	default:
+		return fmt.Errorf("judgehosts must be a table or a list of tables, not %T", data)
+	}
+	return nil
+}
+
+func toHostConfig(table map[string]interface{}) (hostConfig, error) {
+	var host hostConfig
+	for key, value := range table {
+		var ok bool
+		switch key {
+		case "server":
+			host.Server, ok = value.(string)
+		case "port", "slots":
+			var n int64
+			n, ok = value.(int64)
+			if key == "port" {
+				host.Port = int(n)
+			} else {
+				host.Slots = int(n)
+			}
+		default:
+			return hostConfig{}, fmt.Errorf("unknown judgehost setting %q", key)
+		}
+		if !ok {
+			return hostConfig{}, fmt.Errorf("invalid value %v for judgehost setting %q", value, key)
+		}
+	}
+	return host, nil
+}
+
+const defaultReconcileSeconds = 30
+
+type queueConfig struct {
 	Server string
 	Port   int
+	// ReconcileSeconds is how often the queue looks for queued runs it was never told about.
+	ReconcileSeconds int `toml:"reconcile_seconds"`
 }
 
 type config struct {
-	Database   dbConfig
-	Judgehosts hostConfig
+	Database   storage.Config
+	Queue      queueConfig
+	Deadline   deadlineConfig
+	Retry      retryConfig
+	Judgehosts hostConfigs
+}
+
+// queuedRun is a run waiting to be sent to a judgehost.
+type queuedRun struct {
+	id       int64
+	language string
+	deadline time.Duration
+	// attempts is the number of earlier failed attempts at judging the run.
+	attempts int
 }
 
-func NewClient(address string) apipb.JudgehostServiceClient {
+// dialHost creates a connection to a judgehost. The connection is made lazily, so this succeeds even if the host is
+// down.
+func dialHost(address string) *grpc.ClientConn {
 	var opts []grpc.DialOption
 	opts = append(opts, grpc.WithInsecure())
 	conn, err := grpc.Dial(address, opts...)
 	if err != nil {
 		logger.Fatalf("fail to dial: %v", err)
 	}
-	return apipb.NewJudgehostServiceClient(conn)
+	return conn
 }
 
 func main() {
@@ -51,68 +125,273 @@ func main() {
 		panic(err)
 	}
 
-	hostClient := NewClient(fmt.Sprintf("%s:%d", conf.Judgehosts.Server, conf.Judgehosts.Port))
+	policy, err := newRetryPolicy(conf.Retry)
+	if err != nil {
+		panic(err)
+	}
+	pool := newHostPool()
+	for _, host := range conf.Judgehosts {
+		address := fmt.Sprintf("%s:%d", host.Server, host.Port)
+		pool.addHost(address, dialHost(address), host.Slots)
+	}
 
-	connStr := fmt.Sprintf("postgres://omogenjudge:omogenjudge@%s:%d/omogenjudge", conf.Database.Server, conf.Database.Port)
-	if err := storage.Init(connStr); err != nil {
+	store, err := storage.NewGormStore(conf.Database)
+	if err != nil {
 		panic(err)
 	}
 	logger.Info("Starting judging queue")
-	listener := storage.NewListener(connStr)
-	if err := listener.Listen("new_run"); err != nil {
+	go pool.expireHosts()
+	if conf.Queue.Port != 0 {
+		lis, err := net.Listen("tcp", fmt.Sprintf("%s:%d", conf.Queue.Server, conf.Queue.Port))
+		if err != nil {
+			logger.Fatalf("failed to listen: %v", err)
+		}
+		grpcServer := grpc.NewServer()
+		queuepb.RegisterQueueServiceServer(grpcServer, &QueueServer{pool: pool, store: store})
+		go func() {
+			if err := grpcServer.Serve(lis); err != nil {
+				logger.Fatalf("could not listen: %v", err)
+			}
+		}()
+		logger.Infof("Accepting judgehost registrations on %s:%d", conf.Queue.Server, conf.Queue.Port)
+	}
+	listener, err := storage.NewListener(conf.Database, store)
+	if err != nil {
+		logger.Fatalf("Failed creating database listener: %v", err)
+	}
+	if err := listener.Listen(storage.NewRunChannel); err != nil {
 		logger.Fatalf("Failed starting database listener: %v", err)
 	}
 	logger.Infoln("Started database listener")
 
-	var unjudgedRuns []storage.SubmissionRun
-	res := storage.GormDB.Select("submission_run_id").Order("submission_run_id asc").Where("status = ?", storage.StatusQueued).Find(&unjudgedRuns)
-	if res.Error != nil {
-		logger.Fatalf("Failed loading run backlog: %v", res.Error)
+	unjudgedRuns, err := store.QueuedRunIds()
+	if err != nil {
+		logger.Fatalf("Failed loading run backlog: %v", err)
 	}
 	logger.Infof("Had backlog of %d submissions", len(unjudgedRuns))
 	judgeChan := make(chan int64, len(unjudgedRuns)+100)
 	go func() {
-		var alreadyJudged int64 = 0
-		for _, sub := range unjudgedRuns {
-			id := sub.SubmissionRunId
-			judgeChan <- id
-			alreadyJudged = id
+		for _, id := range unjudgedRuns {
+			enqueue(judgeChan, id)
 		}
 		for {
-			notification := <-listener.Notify
-			runId, _ := strconv.ParseInt(notification.Extra, 10, 64)
-			// We may have read some of the newly delivered submissions in our list call,
-			// so we need to filter out any earlier submissions.
-			if runId > alreadyJudged {
-				judgeChan <- runId
+			notification := <-listener.NotificationChannel()
+			if notification == nil {
+				// The listener reconnected, so runs created while it was disconnected were never announced.
+				logger.Infof("Database listener reconnected; looking for queued runs")
+				if err := enqueueQueued(store, judgeChan); err != nil {
+					logger.Warningf("Failed looking for queued runs: %v", err)
+				}
+				continue
 			}
+			// Runs we read in the backlog may be announced again; enqueue skips those still pending,
+			// and runs that were judged in the meantime are skipped when they are loaded.
+			runId, _ := strconv.ParseInt(notification.Extra, 10, 64)
+			enqueue(judgeChan, runId)
 		}
 	}()
+	go reapLeases(store, judgeChan)
+	reconcileInterval := time.Duration(conf.Queue.ReconcileSeconds) * time.Second
+	if reconcileInterval <= 0 {
+		reconcileInterval = defaultReconcileSeconds * time.Second
+	}
+	go reconcileQueued(store, judgeChan, reconcileInterval)
+	runDispatcher := newDispatcher(pool, func(host *judgehost, run queuedRun) {
+		judge(store, pool, policy, judgeChan, host, run)
+	})
 	for sub := range judgeChan {
-		logger.Infof("Sending submission %d for judging", sub)
-		// TODO: give context a deadline to prevent stuck judge hosts...
-		ctx := context.Background()
-		req := &apipb.EvaluateRequest{RunId: sub}
-		for {
-			_, err := hostClient.Evaluate(ctx, req)
-			errcode := status.Code(err)
-			if errcode == codes.Unavailable {
-				logger.Infof("Judge host unavailable; retrying in 10s...")
-				time.Sleep(time.Second * 10)
-				continue
-			}
+		run, err := store.LoadRun(sub)
+		if err != nil {
+			logger.Errorf("Failed loading run %d: %v", sub, err)
+			pendingRuns.remove(sub)
+			continue
+		}
+		if run.Status != storage.StatusQueued {
+			logger.Infof("Run %d is %s and no longer queued; skipping", sub, run.Status)
+			pendingRuns.remove(sub)
+			continue
+		}
+		deadline, err := runDeadline(store, *run, conf.Deadline)
+		if err != nil {
+			logger.Errorf("Failed computing deadline of run %d: %v", sub, err)
+			pendingRuns.remove(sub)
+			continue
+		}
+		queued := queuedRun{
+			id:       sub,
+			language: run.Submission.Language,
+			deadline: deadline,
+			attempts: run.JudgeAttempts,
+		}
+		runDispatcher.dispatch(queued)
+	}
+}
 
-			// TODO: retry failed judging 1 more time
-			if err != nil {
-				logger.Fatalf("Failed judging %d: %v", sub, err)
-				if res := storage.GormDB.Model(
-					&storage.SubmissionRun{SubmissionRunId: sub},
-				).Update("Status", storage.StatusJudgeError); res.Error != nil {
-					logger.Warningf("failed marking run as compiling: %v", res.Error)
-				}
-			}
+// enqueueQueued enqueues all queued runs that are not already pending.
+func enqueueQueued(store storage.Store, judgeChan chan<- int64) error {
+	runIds, err := store.QueuedRunIds()
+	if err != nil {
+		return err
+	}
+	for _, runId := range runIds {
+		enqueue(judgeChan, runId)
+	}
+	return nil
+}
+
+// reconcileQueued periodically enqueues queued runs that are not pending, in case their notification was lost
+// or they were set back to queued by hand.
+func reconcileQueued(store storage.Store, judgeChan chan<- int64, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := enqueueQueued(store, judgeChan); err != nil {
+			logger.Warningf("Failed reconciling queued runs: %v", err)
+		}
+	}
+}
+
+// reapLeases periodically requeues runs whose judgehost stopped renewing its lease, e.g. because it crashed.
+func reapLeases(store storage.Store, judgeChan chan<- int64) {
+	for range time.Tick(storage.LeaseRenewInterval) {
+		runIds, err := store.ReapExpiredLeases()
+		if err != nil {
+			logger.Warningf("Failed reaping expired leases: %v", err)
+			continue
+		}
+		for _, runId := range runIds {
+			logger.Infof("Requeueing run %d after its lease expired", runId)
+			notifyStatus(store, runId, storage.StatusQueued)
+			enqueue(judgeChan, runId)
+		}
+	}
+}
+
+// notifyStatus publishes a status change of the run made by the queue to listeners of run progress.
+func notifyStatus(store storage.Store, runId int64, runStatus string) {
+	if err := store.NotifyProgress(storage.RunProgress{RunId: runId, Status: runStatus}); err != nil {
+		logger.Warningf("%v", err)
+	}
+}
+
+func markJudgeError(store storage.Store, runId int64) {
+	if err := store.MarkJudgeError(runId, storage.JudgeErrorHostFailure); err != nil {
+		logger.Warningf("failed marking run as judging error: %v", err)
+		return
+	}
+	notifyStatus(store, runId, storage.StatusJudgeError)
+}
+
+// requeueUnavailable queues a run again after the judgehost it was sent to turned out to be unavailable, so that it is
+// loaded and dispatched anew like any other queued run.
+func requeueUnavailable(store storage.Store, judgeChan chan<- int64, runId int64) {
+	requeued, err := store.RequeueRun(runId)
+	pendingRuns.remove(runId)
+	if err != nil {
+		logger.Warningf("failed requeueing run: %v", err)
+		markJudgeError(store, runId)
+		return
+	}
+	if !requeued {
+		logger.Infof("Run %d already finished; not requeueing", runId)
+		return
+	}
+	notifyStatus(store, runId, storage.StatusQueued)
+	enqueue(judgeChan, runId)
+}
+
+// evaluateStream judges a run on the host, logging its progress as it is reported.
+func evaluateStream(ctx context.Context, host *judgehost, req *apipb.EvaluateRequest) error {
+	stream, err := host.client.EvaluateStream(ctx, req)
+	if err != nil {
+		return err
+	}
+	for {
+		progress, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch p := progress.Progress.(type) {
+		case *apipb.EvaluateProgress_CompileFinished:
+			logger.Infof("Run %d compiled (success: %v)", req.RunId, p.CompileFinished.Success)
+		case *apipb.EvaluateProgress_TestCaseFinished:
+			logger.Infof("Run %d got %s on test case %d", req.RunId, p.TestCaseFinished.Verdict, p.TestCaseFinished.ProblemTestcaseId)
+		case *apipb.EvaluateProgress_TestGroupFinished:
+			logger.Infof("Run %d got %s on test group %d", req.RunId, p.TestGroupFinished.Verdict, p.TestGroupFinished.ProblemTestgroupId)
+		case *apipb.EvaluateProgress_JudgeError:
+			// The judgehost already marked the run; judging it again would fail the same way.
+			logger.Warningf("Run %d is a judging error (%s): %s", req.RunId, p.JudgeError.Reason, p.JudgeError.Message)
+		}
+	}
+}
+
+// judge sends the run to the given host, retrying it according to the retry policy if judging fails.
+// If the host is unavailable, the run is queued again so that it is dispatched to another host.
+// The slot reserved for the host is released when judging is done.
+func judge(store storage.Store, pool *hostPool, policy *retryPolicy, judgeChan chan<- int64, host *judgehost, run queuedRun) {
+	sub := run.id
+	req := &apipb.EvaluateRequest{RunId: sub}
+	for {
+		logger.Infof("Sending submission %d for judging to %s with deadline %v", sub, host.address, run.deadline)
+		pendingRuns.sentTo(sub, host)
+		ctx, cancel := context.WithTimeout(context.Background(), run.deadline)
+		err := evaluateStream(ctx, host, req)
+		cancel()
+		errcode := status.Code(err)
+		if errcode == codes.Unavailable {
+			logger.Infof("Judge host %s unavailable; moving submission %d to another host...", host.address, sub)
+			pool.markUnavailable(host)
+			pool.release(host)
+			requeueUnavailable(store, judgeChan, sub)
+			return
+		}
+		pool.release(host)
+		if err == nil {
+			break
+		}
+		if errcode == codes.Canceled {
+			// The judgehost marks the run as cancelled itself.
+			logger.Infof("Judging %d was cancelled", sub)
+			break
+		}
+		if errcode == codes.FailedPrecondition {
+			// The run was claimed by someone else, or was taken from the judgehost, e.g. after its lease expired.
+			logger.Infof("Judgehost %s no longer judges %d: %v", host.address, sub, err)
+			break
+		}
+
+		run.attempts++
+		logger.Warningf("Failed judging %d (attempt %d): %v", sub, run.attempts, err)
+		unfinished, recordErr := store.RecordFailedAttempt(sub, run.attempts, err.Error())
+		if recordErr != nil {
+			logger.Warningf("failed recording failed attempt: %v", recordErr)
+		} else if !unfinished {
+			// The judgehost finished the run, e.g. as a judging error, even though the attempt looked like it failed to us.
+			logger.Infof("Run %d already finished; not retrying", sub)
+			break
+		}
+		if !policy.shouldRetry(err, run.attempts) {
+			markJudgeError(store, sub)
+			break
+		}
+		backoff := policy.backoffFor(run.attempts)
+		logger.Infof("Retrying submission %d in %v", sub, backoff)
+		time.Sleep(backoff)
+		requeued, err := store.RequeueRun(sub)
+		if err != nil {
+			logger.Warningf("failed requeueing run: %v", err)
+			markJudgeError(store, sub)
+			break
+		}
+		if !requeued {
+			// The judgehost finished the run even though the attempt looked like it failed to us.
+			logger.Infof("Run %d already finished; not retrying", sub)
 			break
 		}
-		logger.Infof("Done judging run %d", sub)
+		notifyStatus(store, sub, storage.StatusQueued)
+		host = pool.acquire(run.language)
 	}
+	logger.Infof("Done judging run %d", sub)
+	pendingRuns.remove(sub)
 }
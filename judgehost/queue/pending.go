@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sync"
+)
+
+// runSet keeps track of the runs the queue has accepted for judging and not yet finished judging,
+// so that a run that is announced several times is only judged once at a time.
+type runSet struct {
+	mu sync.Mutex
+	// runs maps each run to the judgehost it was sent to, or nil if it is still waiting for one.
+	runs map[int64]*judgehost
+}
+
+var pendingRuns = &runSet{runs: make(map[int64]*judgehost)}
+
+// add adds a run to the set. It returns false if the run was already in it.
+func (s *runSet) add(runId int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.runs[runId]; found {
+		return false
+	}
+	s.runs[runId] = nil
+	return true
+}
+
+// sentTo records the judgehost that a run in the set was sent to.
+func (s *runSet) sentTo(runId int64, host *judgehost) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.runs[runId]; found {
+		s.runs[runId] = host
+	}
+}
+
+// host returns the judgehost a run in the set was sent to, or nil if it has not been sent to any.
+func (s *runSet) host(runId int64) *judgehost {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.runs[runId]
+}
+
+func (s *runSet) remove(runId int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.runs, runId)
+}
+
+// enqueue sends a run to be judged, unless it is already waiting to be judged or being judged.
+func enqueue(judgeChan chan<- int64, runId int64) {
+	if pendingRuns.add(runId) {
+		judgeChan <- runId
+	}
+}
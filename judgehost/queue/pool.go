@@ -0,0 +1,216 @@
+package main
+
+import (
+	"github.com/google/logger"
+	apipb "github.com/jsannemo/omogenhost/judgehost/api"
+	"google.golang.org/grpc"
+	"sync"
+	"time"
+)
+
+// unavailableBackoff is how long a judgehost is kept out of rotation after it reported itself as unavailable.
+const unavailableBackoff = 10 * time.Second
+
+// heartbeatInterval is how often registered judgehosts are asked to send heartbeats.
+const heartbeatInterval = 10 * time.Second
+
+// heartbeatTimeout is how long a registered judgehost may go without a heartbeat before it is removed.
+const heartbeatTimeout = 3 * heartbeatInterval
+
+type judgehost struct {
+	address string
+	// id is the lease owner a registered host takes leases as. Statically configured hosts have none, and are
+	// assumed to take leases under their address.
+	id string
+	// conn is the connection client uses, which is closed when the host is removed.
+	conn   *grpc.ClientConn
+	client apipb.JudgehostServiceClient
+	// slots is the number of runs the host may judge at the same time.
+	slots    int
+	inFlight int
+	// languages is the set of languages the host can judge, or nil if it can judge all of them.
+	languages        map[string]bool
+	unavailableUntil time.Time
+	// registered is set for hosts that registered themselves rather than being configured statically.
+	registered    bool
+	lastHeartbeat time.Time
+	draining      bool
+}
+
+func (h *judgehost) supports(language string) bool {
+	return h.languages == nil || h.languages[language]
+}
+
+// hostPool keeps track of the judgehosts runs can be dispatched to and how many runs each of them is judging.
+type hostPool struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	hosts map[string]*judgehost
+}
+
+func newHostPool() *hostPool {
+	p := &hostPool{hosts: make(map[string]*judgehost)}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// addHost adds a statically configured host that can judge all languages.
+func (p *hostPool) addHost(address string, conn *grpc.ClientConn, slots int) {
+	if slots < 1 {
+		slots = 1
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.hosts[address] = &judgehost{
+		address: address,
+		conn:    conn,
+		client:  apipb.NewJudgehostServiceClient(conn),
+		slots:   slots,
+	}
+	logger.Infof("Added judgehost %s with %d slots", address, slots)
+	p.cond.Broadcast()
+}
+
+// register adds a host that registered itself, or updates it if it was already known.
+// A connection is only made through dial if the host is new.
+func (p *hostPool) register(address string, id string, slots int, languages []string, dial func(string) *grpc.ClientConn) {
+	if slots < 1 {
+		slots = 1
+	}
+	langSet := make(map[string]bool)
+	for _, lang := range languages {
+		langSet[lang] = true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	host, found := p.hosts[address]
+	if !found {
+		conn := dial(address)
+		host = &judgehost{
+			address: address,
+			conn:    conn,
+			client:  apipb.NewJudgehostServiceClient(conn),
+		}
+		p.hosts[address] = host
+	}
+	host.id = id
+	host.slots = slots
+	host.languages = langSet
+	host.registered = true
+	host.draining = false
+	host.lastHeartbeat = time.Now()
+	logger.Infof("Registered judgehost %s with %d slots and languages %v", address, slots, languages)
+	p.cond.Broadcast()
+}
+
+// heartbeat records that the host is alive. It returns false if the host is unknown.
+func (p *hostPool) heartbeat(address string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	host, found := p.hosts[address]
+	if !found {
+		return false
+	}
+	host.lastHeartbeat = time.Now()
+	return true
+}
+
+// hostById returns the host that takes leases as the given owner, or nil if there is none.
+func (p *hostPool) hostById(id string) *judgehost {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, host := range p.hosts {
+		if host.id == id || (host.id == "" && host.address == id) {
+			return host
+		}
+	}
+	return nil
+}
+
+// drain stops new runs from being dispatched to the host, and removes it once it has no runs in flight.
+func (p *hostPool) drain(address string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	host, found := p.hosts[address]
+	if !found {
+		return false
+	}
+	logger.Infof("Draining judgehost %s", address)
+	host.draining = true
+	p.removeDrained(host)
+	return true
+}
+
+func (p *hostPool) removeDrained(host *judgehost) {
+	if host.draining && host.inFlight == 0 && p.hosts[host.address] == host {
+		delete(p.hosts, host.address)
+		logger.Infof("Removed judgehost %s", host.address)
+		if err := host.conn.Close(); err != nil {
+			logger.Warningf("failed closing connection to judgehost %s: %v", host.address, err)
+		}
+	}
+}
+
+// expireHosts periodically drains registered hosts that have stopped sending heartbeats.
+func (p *hostPool) expireHosts() {
+	for range time.Tick(heartbeatInterval) {
+		p.mu.Lock()
+		now := time.Now()
+		for _, host := range p.hosts {
+			if host.registered && !host.draining && now.Sub(host.lastHeartbeat) > heartbeatTimeout {
+				logger.Warningf("Judgehost %s missed its heartbeats", host.address)
+				host.draining = true
+				p.removeDrained(host)
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+// acquire blocks until some judgehost that can judge the language has a free slot, and reserves that slot.
+func (p *hostPool) acquire(language string) *judgehost {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		if host := p.freeHost(language, time.Now()); host != nil {
+			host.inFlight++
+			return host
+		}
+		p.cond.Wait()
+	}
+}
+
+// freeHost returns the least loaded available host with a free slot, or nil if there is none.
+func (p *hostPool) freeHost(language string, now time.Time) *judgehost {
+	var best *judgehost
+	for _, host := range p.hosts {
+		if host.draining || !host.supports(language) || host.inFlight >= host.slots || now.Before(host.unavailableUntil) {
+			continue
+		}
+		if best == nil || host.inFlight*best.slots < best.inFlight*host.slots {
+			best = host
+		}
+	}
+	return best
+}
+
+// release returns a slot reserved by acquire to the pool.
+func (p *hostPool) release(host *judgehost) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	host.inFlight--
+	p.removeDrained(host)
+	p.cond.Broadcast()
+}
+
+// markUnavailable takes the host out of rotation for a while.
+func (p *hostPool) markUnavailable(host *judgehost) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	host.unavailableUntil = time.Now().Add(unavailableBackoff)
+	time.AfterFunc(unavailableBackoff, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.cond.Broadcast()
+	})
+}
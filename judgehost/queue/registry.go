@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"github.com/google/logger"
+	apipb "github.com/jsannemo/omogenhost/judgehost/api"
+	queuepb "github.com/jsannemo/omogenhost/queue/api"
+	"github.com/jsannemo/omogenhost/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// QueueServer lets judgehosts register themselves with the queue's host pool, and runs be cancelled.
+type QueueServer struct {
+	pool  *hostPool
+	store storage.Store
+}
+
+func (q *QueueServer) Register(_ context.Context, request *queuepb.RegisterRequest) (*queuepb.RegisterResponse, error) {
+	if request.Address == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing judgehost address")
+	}
+	q.pool.register(request.Address, request.HostId, int(request.Slots), request.Languages, dialHost)
+	return &queuepb.RegisterResponse{
+		HeartbeatIntervalMs: heartbeatInterval.Milliseconds(),
+	}, nil
+}
+
+func (q *QueueServer) Heartbeat(_ context.Context, request *queuepb.HeartbeatRequest) (*queuepb.HeartbeatResponse, error) {
+	known := q.pool.heartbeat(request.Address)
+	if !known {
+		logger.Infof("Heartbeat from unknown judgehost %s", request.Address)
+	}
+	return &queuepb.HeartbeatResponse{UnknownHost: !known}, nil
+}
+
+func (q *QueueServer) Drain(_ context.Context, request *queuepb.DrainRequest) (*queuepb.DrainResponse, error) {
+	if !q.pool.drain(request.Address) {
+		return nil, status.Errorf(codes.NotFound, "unknown judgehost %s", request.Address)
+	}
+	return &queuepb.DrainResponse{}, nil
+}
+
+// Cancel marks a queued run as cancelled, or forwards the cancellation to the judgehost judging the run.
+func (q *QueueServer) Cancel(ctx context.Context, request *queuepb.CancelRequest) (*queuepb.CancelResponse, error) {
+	runId := request.RunId
+	cancelled, err := q.store.CancelQueuedRun(runId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed cancelling run %d: %v", runId, err)
+	}
+	if cancelled {
+		// A judgehost the run was already sent to skips it, since it can no longer be claimed.
+		logger.Infof("Cancelled queued run %d", runId)
+		notifyStatus(q.store, runId, storage.StatusCancelled)
+		return &queuepb.CancelResponse{Cancelled: true}, nil
+	}
+	client, err := q.judgingHost(runId)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		return &queuepb.CancelResponse{}, nil
+	}
+	logger.Infof("Forwarding cancellation of run %d to its judgehost", runId)
+	response, err := client.Cancel(ctx, &apipb.CancelRequest{RunId: runId})
+	if err != nil {
+		return nil, err
+	}
+	return &queuepb.CancelResponse{Cancelled: response.Cancelled}, nil
+}
+
+// judgingHost returns a client of the judgehost judging a run. This is the host the queue sent the run to, or else
+// the holder of the lease on the run, which may have been sent the run by an earlier queue. A nil client is returned
+// if no judgehost is judging the run.
+func (q *QueueServer) judgingHost(runId int64) (apipb.JudgehostServiceClient, error) {
+	if host := pendingRuns.host(runId); host != nil {
+		return host.client, nil
+	}
+	run, err := q.store.LoadRun(runId)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "failed loading run %d: %v", runId, err)
+	}
+	if !run.LeaseOwner.Valid {
+		return nil, nil
+	}
+	// The lease owner names the host, but need not be an address the queue can reach it on.
+	host := q.pool.hostById(run.LeaseOwner.String)
+	if host == nil {
+		return nil, status.Errorf(codes.Unavailable, "judgehost %s judging run %d is not in the pool", run.LeaseOwner.String, runId)
+	}
+	return host.client, nil
+}
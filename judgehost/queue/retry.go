@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+const (
+	defaultMaxAttempts    = 2
+	defaultBackoffSeconds = 10
+)
+
+var defaultRetryableCodes = []string{"Internal", "Aborted"}
+
+type retryConfig struct {
+	// MaxAttempts is the number of times a run is sent for judging before it is marked as a judging error.
+	MaxAttempts int `toml:"max_attempts"`
+	// BackoffSeconds is how long to wait before the first retry. The wait doubles for every further retry.
+	BackoffSeconds int `toml:"backoff_seconds"`
+	// RetryableCodes are the names of the gRPC codes that are worth retrying, e.g. "Internal".
+	RetryableCodes []string `toml:"retryable_codes"`
+}
+
+type retryPolicy struct {
+	maxAttempts int
+	backoff     time.Duration
+	retryable   map[codes.Code]bool
+}
+
+func newRetryPolicy(conf retryConfig) (*retryPolicy, error) {
+	policy := &retryPolicy{
+		maxAttempts: conf.MaxAttempts,
+		backoff:     time.Duration(conf.BackoffSeconds) * time.Second,
+		retryable:   make(map[codes.Code]bool),
+	}
+	if policy.maxAttempts <= 0 {
+		policy.maxAttempts = defaultMaxAttempts
+	}
+	if policy.backoff <= 0 {
+		policy.backoff = defaultBackoffSeconds * time.Second
+	}
+	codeNames := conf.RetryableCodes
+	if codeNames == nil {
+		codeNames = defaultRetryableCodes
+	}
+	for _, name := range codeNames {
+		code, err := parseCode(name)
+		if err != nil {
+			return nil, err
+		}
+		policy.retryable[code] = true
+	}
+	return policy, nil
+}
+
+func parseCode(name string) (codes.Code, error) {
+	for code := codes.OK; code <= codes.Unauthenticated; code++ {
+		if code.String() == name {
+			return code, nil
+		}
+	}
+	return codes.Unknown, fmt.Errorf("unknown gRPC code: %s", name)
+}
+
+// shouldRetry decides whether a run that failed with the given error after some number of attempts should be judged again.
+func (p *retryPolicy) shouldRetry(err error, attempts int) bool {
+	return attempts < p.maxAttempts && p.retryable[status.Code(err)]
+}
+
+// backoffFor returns how long to wait before the next attempt.
+func (p *retryPolicy) backoffFor(attempts int) time.Duration {
+	return p.backoff << (attempts - 1)
+}
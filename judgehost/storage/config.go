@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+)
+
+// Config is the [database] section of the configuration files.
+type Config struct {
+	Server string
+	Port   int
+	// User, Password and Name default to omogenjudge.
+	User     string
+	Password string
+	// PasswordFile is a file containing the password, used instead of Password if set.
+	PasswordFile string `toml:"password_file"`
+	Name         string
+	// SslMode is the libpq sslmode, e.g. "verify-full". SslRootCert is the CA certificate to verify the server with,
+	// while SslCert and SslKey are an optional client certificate.
+	SslMode     string `toml:"sslmode"`
+	SslRootCert string `toml:"sslrootcert"`
+	SslCert     string `toml:"sslcert"`
+	SslKey      string `toml:"sslkey"`
+	// MaxOpenConns and MaxIdleConns limit the connection pool; zero keeps the database/sql defaults.
+	MaxOpenConns int `toml:"max_open_conns"`
+	MaxIdleConns int `toml:"max_idle_conns"`
+	// ConnMaxLifetimeSeconds is how long a connection may be reused; zero means forever.
+	ConnMaxLifetimeSeconds int `toml:"conn_max_lifetime_seconds"`
+	// Sqlite is the path of a SQLite database, or a SQLite DSN, to use instead of Postgres.
+	// The tables the judge needs are created if they are missing. Meant for single-machine and development setups.
+	Sqlite string `toml:"sqlite"`
+}
+
+func orDefault(value string, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+// ConnString returns the connection string for the configured database.
+func (c Config) ConnString() (string, error) {
+	password := orDefault(c.Password, "omogenjudge")
+	if c.PasswordFile != "" {
+		data, err := ioutil.ReadFile(c.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("failed reading database password file: %v", err)
+		}
+		password = strings.TrimSpace(string(data))
+	}
+	params := url.Values{}
+	for key, value := range map[string]string{
+		"sslmode":     c.SslMode,
+		"sslrootcert": c.SslRootCert,
+		"sslcert":     c.SslCert,
+		"sslkey":      c.SslKey,
+	} {
+		if value != "" {
+			params.Set(key, value)
+		}
+	}
+	connUrl := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(orDefault(c.User, "omogenjudge"), password),
+		Host:     fmt.Sprintf("%s:%d", c.Server, c.Port),
+		Path:     "/" + orDefault(c.Name, "omogenjudge"),
+		RawQuery: params.Encode(),
+	}
+	return connUrl.String(), nil
+}
@@ -2,37 +2,118 @@ package storage
 
 import (
 	"database/sql"
-	"github.com/google/logger"
-	"github.com/lib/pq"
+	"fmt"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/gorm/schema"
 	"time"
 )
 
-var Db *sql.DB
-var GormDB *gorm.DB
+var _ Store = (*GormStore)(nil)
 
-func Init(connStr string) error {
+// GormStore is the Store kept in the database of the judge, which is Postgres unless SQLite is configured.
+type GormStore struct {
+	db *gorm.DB
+	// sqlite is whether the database is a SQLite file, which is only shared by processes on the same machine.
+	sqlite bool
+}
+
+// NewGormStore connects to the configured database.
+func NewGormStore(conf Config) (*GormStore, error) {
+	var db *sql.DB
+	var dialector gorm.Dialector
 	var err error
-	Db, err = sql.Open("postgres", connStr)
-	GormDB, err = gorm.Open(postgres.New(postgres.Config{
-		Conn: Db,
-	}), &gorm.Config{
+	if conf.Sqlite != "" {
+		db, dialector, err = openSqlite(conf.Sqlite)
+	} else {
+		db, dialector, err = openPostgres(conf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if conf.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(conf.MaxOpenConns)
+	}
+	if conf.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(conf.MaxIdleConns)
+	}
+	if conf.ConnMaxLifetimeSeconds > 0 {
+		db.SetConnMaxLifetime(time.Duration(conf.ConnMaxLifetimeSeconds) * time.Second)
+	}
+	gormDB, err := gorm.Open(dialector, &gorm.Config{
 		NamingStrategy: schema.NamingStrategy{
 			SingularTable: true,
 		},
+		// The frontend owns the schema and its constraints. Migrations only create the tables SQLite setups need.
+		DisableForeignKeyConstraintWhenMigrating: true,
 	})
-	return err
+	if err != nil {
+		return nil, err
+	}
+	if conf.Sqlite != "" {
+		if err := migrateSqlite(gormDB); err != nil {
+			return nil, err
+		}
+	}
+	return &GormStore{db: gormDB, sqlite: conf.Sqlite != ""}, nil
 }
 
-func NewListener(connStr string) *pq.Listener {
-	reportProblem := func(ev pq.ListenerEventType, err error) {
-		if err != nil {
-			logger.Fatalf("Postgres listener failure: %v", err)
-		}
+func openPostgres(conf Config) (*sql.DB, gorm.Dialector, error) {
+	connStr, err := conf.ConnString()
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed opening database: %v", err)
+	}
+	return db, postgres.New(postgres.Config{Conn: db}), nil
+}
+
+func (s *GormStore) QueuedRunIds() ([]int64, error) {
+	var runIds []int64
+	res := s.db.Model(&SubmissionRun{}).Where("status = ?", StatusQueued).Order("submission_run_id asc").Pluck("submission_run_id", &runIds)
+	return runIds, res.Error
+}
+
+func (s *GormStore) LoadRun(runId int64) (*SubmissionRun, error) {
+	var run SubmissionRun
+	if res := s.db.Joins("Submission").Joins("ProblemVersion").Preload("ProblemVersion.OutputValidator").Preload("ProblemVersion.CustomGrader").First(&run, runId); res.Error != nil {
+		return nil, res.Error
 	}
-	minReconn := 10 * time.Second
-	maxReconn := time.Minute
-	return pq.NewListener(connStr, minReconn, maxReconn, reportProblem)
+	return &run, nil
+}
+
+func (s *GormStore) LoadProblemVersion(problemVersionId int64) (*ProblemVersion, error) {
+	var version ProblemVersion
+	if res := s.db.First(&version, problemVersionId); res.Error != nil {
+		return nil, res.Error
+	}
+	return &version, nil
+}
+
+func (s *GormStore) LoadTestgroups(problemVersionId int64) ([]*ProblemTestgroup, error) {
+	var groups []*ProblemTestgroup
+	res := s.db.Where("problem_version_id = ?", problemVersionId).Preload("ProblemTestcases").Order("problem_testgroup_id asc").Find(&groups)
+	return groups, res.Error
+}
+
+func (s *GormStore) CountTestcases(problemVersionId int64) (int64, error) {
+	var testcases int64
+	res := s.db.Model(&ProblemTestcase{}).
+		Joins("JOIN problem_testgroup ON problem_testgroup.problem_testgroup_id = problem_testcase.problem_testgroup_id").
+		Where("problem_testgroup.problem_version_id = ?", problemVersionId).
+		Count(&testcases)
+	return testcases, res.Error
+}
+
+func (s *GormStore) LoadStoredFiles(fileHashes []string) ([]StoredFile, error) {
+	var files []StoredFile
+	res := s.db.Find(&files, fileHashes)
+	return files, res.Error
+}
+
+func (s *GormStore) UpdateRun(run *SubmissionRun, leaseOwner string, fields ...string) (bool, error) {
+	res := s.db.Where("lease_owner = ?", leaseOwner).Select(fields).Save(run)
+	return res.RowsAffected != 0, res.Error
 }
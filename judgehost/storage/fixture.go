@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// The Add methods of GormStore fill a development database, which the frontend would otherwise fill.
+// They assign the IDs of the added records.
+
+// AddStoredFile adds a file, unless a file with the same hash already exists.
+func (s *GormStore) AddStoredFile(file StoredFile) error {
+	return s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&file).Error
+}
+
+// AddProblemVersion adds a problem version together with its test groups and their test cases, and a new problem
+// whose current version it is. The test cases must refer to stored files.
+// The root group comes first and has no parent, while every other group comes after its parent.
+func (s *GormStore) AddProblemVersion(version *ProblemVersion, groups []*ProblemTestgroup) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		problem := Problem{}
+		if res := tx.Omit("CurrentVersion").Create(&problem); res.Error != nil {
+			return res.Error
+		}
+		version.ProblemId = problem.ProblemId
+		if res := tx.Omit("RootGroup", "OutputValidator", "CustomGrader").Create(version); res.Error != nil {
+			return res.Error
+		}
+		for _, group := range groups {
+			group.ProblemVersionId = version.ProblemVersionId
+			if group.Parent != nil {
+				group.ParentId = group.Parent.ProblemTestgroupId
+			}
+			if res := tx.Omit("Parent", "ProblemVersion").Create(group); res.Error != nil {
+				return res.Error
+			}
+		}
+		version.RootGroupId = groups[0].ProblemTestgroupId
+		if res := tx.Model(version).Update("root_group_id", version.RootGroupId); res.Error != nil {
+			return res.Error
+		}
+		problem.CurrentVersionId = version.ProblemVersionId
+		return tx.Model(&problem).Update("current_version_id", problem.CurrentVersionId).Error
+	})
+}
+
+// AddSubmission adds a submission together with a queued run of it on the given problem version.
+func (s *GormStore) AddSubmission(submission *Submission, problemVersionId int64) (*SubmissionRun, error) {
+	run := &SubmissionRun{
+		ProblemVersionId: problemVersionId,
+		Status:           StatusQueued,
+		Verdict:          VerdictUnjudged,
+	}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if res := tx.Create(submission); res.Error != nil {
+			return res.Error
+		}
+		run.SubmissionId = submission.SubmissionId
+		return tx.Omit("Submission", "ProblemVersion").Create(run).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return run, nil
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// LeaseDuration is how long a claimed run belongs to its owner unless the lease is renewed.
+const LeaseDuration = time.Minute
+
+// LeaseRenewInterval is how often the owner of a run should renew its lease.
+const LeaseRenewInterval = LeaseDuration / 3
+
+// now returns the current time, as seen by the database.
+// Leases are taken by judgehosts and reaped by the queue, so they are timed by a single clock even if those run on
+// different machines. A SQLite database can only be shared on one machine, whose clock is used instead.
+func (s *GormStore) now() interface{} {
+	if s.sqlite {
+		return time.Now()
+	}
+	return gorm.Expr("now()")
+}
+
+// leaseExpiry returns when a lease taken or renewed now expires.
+func (s *GormStore) leaseExpiry() interface{} {
+	if s.sqlite {
+		return time.Now().Add(LeaseDuration)
+	}
+	return gorm.Expr("now() + ?::interval", fmt.Sprintf("%d milliseconds", LeaseDuration.Milliseconds()))
+}
+
+// ClaimRun leases a queued run to the given owner and marks it as compiling.
+// It returns false if the run was not queued, e.g. if someone else already claimed it.
+func (s *GormStore) ClaimRun(runId int64, owner string) (bool, error) {
+	res := s.db.Model(&SubmissionRun{}).
+		Where("submission_run_id = ? AND status = ?", runId, StatusQueued).
+		Updates(map[string]interface{}{
+			"status":       StatusCompiling,
+			"lease_owner":  owner,
+			"lease_expiry": s.leaseExpiry(),
+		})
+	return res.RowsAffected == 1, res.Error
+}
+
+// RenewLease extends the owner's lease on a run.
+// It returns false if the owner no longer holds the lease.
+func (s *GormStore) RenewLease(runId int64, owner string) (bool, error) {
+	res := s.db.Model(&SubmissionRun{}).
+		Where("submission_run_id = ? AND lease_owner = ?", runId, owner).
+		Update("lease_expiry", s.leaseExpiry())
+	return res.RowsAffected == 1, res.Error
+}
+
+// ReleaseLease gives up the owner's lease on a run once it has been judged.
+func (s *GormStore) ReleaseLease(runId int64, owner string) error {
+	return s.db.Model(&SubmissionRun{}).
+		Where("submission_run_id = ? AND lease_owner = ?", runId, owner).
+		Updates(map[string]interface{}{
+			"lease_owner":  nil,
+			"lease_expiry": nil,
+		}).Error
+}
+
+// ReapExpiredLeases returns runs whose lease expired while being judged to the queue, removing any partial results.
+// The IDs of the requeued runs are returned.
+func (s *GormStore) ReapExpiredLeases() ([]int64, error) {
+	var runIds []int64
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var runs []SubmissionRun
+		if res := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("submission_run_id").
+			Where("lease_expiry < ? AND status IN ?", s.now(), []string{StatusCompiling, StatusRunning}).
+			Find(&runs); res.Error != nil {
+			return res.Error
+		}
+		for _, run := range runs {
+			runIds = append(runIds, run.SubmissionRunId)
+		}
+		if len(runIds) == 0 {
+			return nil
+		}
+		if res := tx.Model(&SubmissionRun{}).
+			Where("submission_run_id IN ?", runIds).
+			Updates(map[string]interface{}{
+				"judge_attempts": gorm.Expr("judge_attempts + 1"),
+				"judge_error":    "judgehost lease expired",
+			}); res.Error != nil {
+			return res.Error
+		}
+		return requeueRuns(tx, runIds)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return runIds, nil
+}
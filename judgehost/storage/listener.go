@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/google/logger"
+	"github.com/lib/pq"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// NewRunChannel is the channel that the IDs of new runs are announced on.
+const NewRunChannel = "new_run"
+
+// Listener delivers the notifications of the channels it listens to.
+// A nil notification is delivered after the listener has reconnected, since notifications may have been lost while
+// it was disconnected.
+type Listener interface {
+	Listen(channel string) error
+	NotificationChannel() <-chan *pq.Notification
+}
+
+// NewListener listens to notifications of the configured database.
+// SQLite has no notifications, so new runs are instead found by polling the store.
+func NewListener(conf Config, store Store) (Listener, error) {
+	if conf.Sqlite != "" {
+		return newPollingListener(store, pollInterval), nil
+	}
+	connStr, err := conf.ConnString()
+	if err != nil {
+		return nil, err
+	}
+	// The listener keeps reconnecting on its own, so connection problems are only logged.
+	reportProblem := func(ev pq.ListenerEventType, err error) {
+		switch ev {
+		case pq.ListenerEventDisconnected:
+			logger.Warningf("Postgres listener disconnected: %v", err)
+		case pq.ListenerEventConnectionAttemptFailed:
+			logger.Warningf("Postgres listener failed to reconnect: %v", err)
+		case pq.ListenerEventReconnected:
+			logger.Infof("Postgres listener reconnected")
+		}
+	}
+	minReconn := 10 * time.Second
+	maxReconn := time.Minute
+	return pq.NewListener(connStr, minReconn, maxReconn, reportProblem), nil
+}
+
+// pollInterval is how often new runs are polled for.
+const pollInterval = time.Second
+
+// pollingListener announces new runs on NewRunChannel by polling for queued runs.
+// Like the notifications sent when runs are created, each run is announced once, even if it is queued again later.
+type pollingListener struct {
+	store    Store
+	interval time.Duration
+	notify   chan *pq.Notification
+	start    sync.Once
+}
+
+func newPollingListener(store Store, interval time.Duration) *pollingListener {
+	return &pollingListener{
+		store:    store,
+		interval: interval,
+		notify:   make(chan *pq.Notification, 32),
+	}
+}
+
+func (l *pollingListener) Listen(channel string) error {
+	if channel != NewRunChannel {
+		return fmt.Errorf("can only poll for new runs, not %s", channel)
+	}
+	l.start.Do(func() { go l.poll() })
+	return nil
+}
+
+func (l *pollingListener) NotificationChannel() <-chan *pq.Notification {
+	return l.notify
+}
+
+func (l *pollingListener) poll() {
+	var newestRun int64
+	for range time.Tick(l.interval) {
+		runIds, err := l.store.QueuedRunIds()
+		if err != nil {
+			logger.Warningf("failed polling for new runs: %v", err)
+			continue
+		}
+		for _, runId := range runIds {
+			if runId > newestRun {
+				l.notify <- &pq.Notification{Channel: NewRunChannel, Extra: strconv.FormatInt(runId, 10)}
+				newestRun = runId
+			}
+		}
+	}
+}
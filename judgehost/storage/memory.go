@@ -0,0 +1,412 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"gorm.io/gorm"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+var _ Store = (*MemoryStore)(nil)
+
+// MemoryStore is a Store kept in memory, for use in tests.
+// Records are added with the Add methods, and the results of judging are inspected with the remaining accessors.
+type MemoryStore struct {
+	mu           sync.Mutex
+	submissions  map[int64]Submission
+	versions     map[int64]ProblemVersion
+	groups       map[int64]ProblemTestgroup
+	files        map[string]StoredFile
+	runs         map[int64]SubmissionRun
+	caseRuns     map[int64][]SubmissionCaseRun
+	groupRuns    map[int64][]SubmissionGroupRun
+	progress     []RunProgress
+	nextResultId int64
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		submissions: make(map[int64]Submission),
+		versions:    make(map[int64]ProblemVersion),
+		groups:      make(map[int64]ProblemTestgroup),
+		files:       make(map[string]StoredFile),
+		runs:        make(map[int64]SubmissionRun),
+		caseRuns:    make(map[int64][]SubmissionCaseRun),
+		groupRuns:   make(map[int64][]SubmissionGroupRun),
+	}
+}
+
+func (s *MemoryStore) AddSubmission(submission Submission) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.submissions[submission.SubmissionId] = submission
+}
+
+// AddProblemVersion adds a problem version together with its output validator and grader.
+func (s *MemoryStore) AddProblemVersion(version ProblemVersion) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.versions[version.ProblemVersionId] = version
+}
+
+// AddTestgroup adds a test group together with its test cases.
+func (s *MemoryStore) AddTestgroup(group ProblemTestgroup) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.groups[group.ProblemTestgroupId] = group
+}
+
+func (s *MemoryStore) AddStoredFile(file StoredFile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[file.FileHash] = file
+}
+
+// AddRun adds a run. Its submission and problem version are taken from the store when the run is loaded.
+func (s *MemoryStore) AddRun(run SubmissionRun) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.runs[run.SubmissionRunId] = run
+}
+
+// Run returns the stored run, without its submission and problem version.
+func (s *MemoryStore) Run(runId int64) (SubmissionRun, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	run, found := s.runs[runId]
+	return run, found
+}
+
+// CaseRuns returns the stored test case results of a run.
+func (s *MemoryStore) CaseRuns(runId int64) []SubmissionCaseRun {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]SubmissionCaseRun(nil), s.caseRuns[runId]...)
+}
+
+// GroupRuns returns the stored test group results of a run.
+func (s *MemoryStore) GroupRuns(runId int64) []SubmissionGroupRun {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]SubmissionGroupRun(nil), s.groupRuns[runId]...)
+}
+
+// Progress returns all progress published so far, in order.
+func (s *MemoryStore) Progress() []RunProgress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]RunProgress(nil), s.progress...)
+}
+
+func (s *MemoryStore) QueuedRunIds() ([]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var runIds []int64
+	for id, run := range s.runs {
+		if run.Status == StatusQueued {
+			runIds = append(runIds, id)
+		}
+	}
+	sort.Slice(runIds, func(i, j int) bool { return runIds[i] < runIds[j] })
+	return runIds, nil
+}
+
+func (s *MemoryStore) LoadRun(runId int64) (*SubmissionRun, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	run, found := s.runs[runId]
+	if !found {
+		return nil, gorm.ErrRecordNotFound
+	}
+	run.Submission = s.submissions[run.SubmissionId]
+	run.ProblemVersion = s.versions[run.ProblemVersionId]
+	return &run, nil
+}
+
+func (s *MemoryStore) LoadProblemVersion(problemVersionId int64) (*ProblemVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	version, found := s.versions[problemVersionId]
+	if !found {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &version, nil
+}
+
+func (s *MemoryStore) LoadTestgroups(problemVersionId int64) ([]*ProblemTestgroup, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var groups []*ProblemTestgroup
+	for _, group := range s.groups {
+		if group.ProblemVersionId == problemVersionId {
+			group := group
+			group.ProblemTestcases = append([]ProblemTestcase(nil), group.ProblemTestcases...)
+			groups = append(groups, &group)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].ProblemTestgroupId < groups[j].ProblemTestgroupId })
+	return groups, nil
+}
+
+func (s *MemoryStore) CountTestcases(problemVersionId int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var testcases int64
+	for _, group := range s.groups {
+		if group.ProblemVersionId == problemVersionId {
+			testcases += int64(len(group.ProblemTestcases))
+		}
+	}
+	return testcases, nil
+}
+
+func (s *MemoryStore) LoadStoredFiles(fileHashes []string) ([]StoredFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var files []StoredFile
+	for _, hash := range fileHashes {
+		if file, found := s.files[hash]; found {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+func (s *MemoryStore) ClaimRun(runId int64, owner string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	run, found := s.runs[runId]
+	if !found || run.Status != StatusQueued {
+		return false, nil
+	}
+	run.Status = StatusCompiling
+	run.LeaseOwner = sql.NullString{String: owner, Valid: true}
+	run.LeaseExpiry = sql.NullTime{Time: time.Now().Add(LeaseDuration), Valid: true}
+	s.runs[runId] = run
+	return true, nil
+}
+
+func (s *MemoryStore) RenewLease(runId int64, owner string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	run, found := s.runs[runId]
+	if !found || !holdsLease(run, owner) {
+		return false, nil
+	}
+	run.LeaseExpiry = sql.NullTime{Time: time.Now().Add(LeaseDuration), Valid: true}
+	s.runs[runId] = run
+	return true, nil
+}
+
+func (s *MemoryStore) ReleaseLease(runId int64, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	run, found := s.runs[runId]
+	if !found || !holdsLease(run, owner) {
+		return nil
+	}
+	run.LeaseOwner = sql.NullString{}
+	run.LeaseExpiry = sql.NullTime{}
+	s.runs[runId] = run
+	return nil
+}
+
+func (s *MemoryStore) ReapExpiredLeases() ([]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var runIds []int64
+	for id, run := range s.runs {
+		if run.LeaseExpiry.Valid && run.LeaseExpiry.Time.Before(time.Now()) &&
+			(run.Status == StatusCompiling || run.Status == StatusRunning) {
+			run.JudgeAttempts++
+			run.JudgeError = "judgehost lease expired"
+			s.runs[id] = run
+			s.requeue(id)
+			runIds = append(runIds, id)
+		}
+	}
+	return runIds, nil
+}
+
+func (s *MemoryStore) UpdateRun(run *SubmissionRun, leaseOwner string, fields ...string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, found := s.runs[run.SubmissionRunId]
+	if !found || !holdsLease(stored, leaseOwner) {
+		return false, nil
+	}
+	if err := copyFields(&stored, run, fields); err != nil {
+		return false, err
+	}
+	s.runs[run.SubmissionRunId] = stored
+	return true, nil
+}
+
+func (s *MemoryStore) RecordFailedAttempt(runId int64, attempts int, reason string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	run, found := s.runs[runId]
+	if !found || isFinished(run) {
+		return false, nil
+	}
+	run.JudgeAttempts = attempts
+	run.JudgeError = reason
+	s.runs[runId] = run
+	return true, nil
+}
+
+func (s *MemoryStore) MarkJudgeError(runId int64, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	run, found := s.runs[runId]
+	if !found || isFinished(run) {
+		return nil
+	}
+	run.Status = StatusJudgeError
+	run.Verdict = VerdictJudgeError
+	run.JudgeErrorReason = reason
+	run.LeaseOwner = sql.NullString{}
+	run.LeaseExpiry = sql.NullTime{}
+	s.runs[runId] = run
+	return nil
+}
+
+func (s *MemoryStore) RequeueRun(runId int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	run, found := s.runs[runId]
+	if !found {
+		return false, gorm.ErrRecordNotFound
+	}
+	if isFinished(run) {
+		return false, nil
+	}
+	s.requeue(runId)
+	return true, nil
+}
+
+func (s *MemoryStore) CancelQueuedRun(runId int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	run, found := s.runs[runId]
+	if !found || run.Status != StatusQueued {
+		return false, nil
+	}
+	run.Status = StatusCancelled
+	s.runs[runId] = run
+	return true, nil
+}
+
+func (s *MemoryStore) WriteResults(runId int64, leaseOwner string, caseRuns []SubmissionCaseRun, groupRuns []SubmissionGroupRun) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	run, found := s.runs[runId]
+	if !found || !holdsLease(run, leaseOwner) {
+		return ErrLeaseLost
+	}
+	for _, caseRun := range caseRuns {
+		s.nextResultId++
+		caseRun.SubmissionCaseRunId = s.nextResultId
+		if caseRun.Feedback != nil {
+			feedback := *caseRun.Feedback
+			feedback.SubmissionCaseRunId = s.nextResultId
+			caseRun.Feedback = &feedback
+		}
+		s.caseRuns[runId] = append(s.caseRuns[runId], caseRun)
+	}
+	for _, groupRun := range groupRuns {
+		s.nextResultId++
+		groupRun.SubmissionGroupRunId = s.nextResultId
+		s.groupRuns[runId] = append(s.groupRuns[runId], groupRun)
+	}
+	return nil
+}
+
+func (s *MemoryStore) FinishRun(run *SubmissionRun, leaseOwner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, found := s.runs[run.SubmissionRunId]
+	if !found || !holdsLease(stored, leaseOwner) {
+		return ErrLeaseLost
+	}
+	run.Status = StatusDone
+	if err := copyFields(&stored, run, finishedRunFields); err != nil {
+		return err
+	}
+	s.runs[run.SubmissionRunId] = stored
+	s.keepResults(run.SubmissionRunId, func(attemptId string) bool { return attemptId == run.AttemptId })
+	return nil
+}
+
+func (s *MemoryStore) DiscardResults(runId int64, attemptId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keepResults(runId, func(resultAttempt string) bool { return resultAttempt != attemptId })
+	return nil
+}
+
+// keepResults removes the results of a run whose attempt id doesn't satisfy keep. The caller must hold s.mu.
+func (s *MemoryStore) keepResults(runId int64, keep func(attemptId string) bool) {
+	var caseRuns []SubmissionCaseRun
+	for _, caseRun := range s.caseRuns[runId] {
+		if keep(caseRun.AttemptId) {
+			caseRuns = append(caseRuns, caseRun)
+		}
+	}
+	s.caseRuns[runId] = caseRuns
+	var groupRuns []SubmissionGroupRun
+	for _, groupRun := range s.groupRuns[runId] {
+		if keep(groupRun.AttemptId) {
+			groupRuns = append(groupRuns, groupRun)
+		}
+	}
+	s.groupRuns[runId] = groupRuns
+}
+
+func (s *MemoryStore) NotifyProgress(progress ...RunProgress) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.progress = append(s.progress, progress...)
+	return nil
+}
+
+// requeue returns a run to the queue. The caller must hold s.mu.
+func (s *MemoryStore) requeue(runId int64) {
+	run := s.runs[runId]
+	run.Status = StatusQueued
+	run.LeaseOwner = sql.NullString{}
+	run.LeaseExpiry = sql.NullTime{}
+	s.runs[runId] = run
+	delete(s.caseRuns, runId)
+	delete(s.groupRuns, runId)
+}
+
+func holdsLease(run SubmissionRun, owner string) bool {
+	return run.LeaseOwner.Valid && run.LeaseOwner.String == owner
+}
+
+func isFinished(run SubmissionRun) bool {
+	for _, status := range finishedStatuses {
+		if run.Status == status {
+			return true
+		}
+	}
+	return false
+}
+
+// copyFields copies the named fields of a run.
+func copyFields(dst, src *SubmissionRun, fields []string) error {
+	dstVal := reflect.ValueOf(dst).Elem()
+	srcVal := reflect.ValueOf(src).Elem()
+	for _, field := range fields {
+		dstField := dstVal.FieldByName(field)
+		if !dstField.IsValid() {
+			return fmt.Errorf("run has no field %s", field)
+		}
+		dstField.Set(srcVal.FieldByName(field))
+	}
+	return nil
+}
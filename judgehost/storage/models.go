@@ -75,6 +75,7 @@ type ProblemTestgroup struct {
 	BreakOnReject        bool
 	AcceptIfAnyAccepted  bool
 	IgnoreSample         bool
+	IsSample             bool
 	ScoringMode          string
 	VerdictMode          string
 	GraderFlags          pq.StringArray `gorm:"type:text[]"`
@@ -90,6 +91,7 @@ type ProblemVersion struct {
 	RootGroup         *ProblemTestgroup `gorm:"foreignKey:RootGroupId; References:ProblemTestgroupId"`
 	TimeLimitMs       int64
 	MemoryLimitKb     int64
+	OutputLimitKb     int64
 	OutputValidatorId int64
 	OutputValidator   ProblemOutputValidator
 	CustomGraderId    int64
@@ -97,7 +99,9 @@ type ProblemVersion struct {
 	IncludedFiles     JSON
 	Scoring           bool
 	Interactive       bool
-	ScoreMaximization sql.NullBool
+	// RejectOnSampleFailure is whether runs that fail the samples are rejected without being judged on all test data.
+	RejectOnSampleFailure bool
+	ScoreMaximization     sql.NullBool
 }
 
 type SubmissionCaseRun struct {
@@ -110,6 +114,17 @@ type SubmissionCaseRun struct {
 	TimeUsageMs         int64
 	Score               float64
 	Verdict             Verdict
+	AttemptId           string
+	Feedback            *SubmissionCaseFeedback `gorm:"foreignKey:SubmissionCaseRunId"`
+}
+
+// SubmissionCaseFeedback holds excerpts of what the program and the output validator said about a test case.
+type SubmissionCaseFeedback struct {
+	SubmissionCaseRunId int64 `gorm:"primaryKey"`
+	JudgeMessage        string
+	TeamMessage         string
+	Stderr              string
+	FirstMismatch       string
 }
 
 type SubmissionGroupRun struct {
@@ -122,6 +137,7 @@ type SubmissionGroupRun struct {
 	TimeUsageMs          int64
 	Score                float64
 	Verdict              Verdict
+	AttemptId            string
 }
 
 const (
@@ -130,17 +146,29 @@ const (
 	StatusRunning      = "running"
 	StatusCompileError = "compile error"
 	StatusJudgeError   = "judging error"
+	StatusCancelled    = "cancelled"
 	StatusDone         = "done"
 )
 
+// Reasons for a run ending up as a judging error.
+const (
+	JudgeErrorAborted        = "aborted"
+	JudgeErrorEvaluator      = "evaluator_error"
+	JudgeErrorUnknownVerdict = "unknown_verdict"
+	JudgeErrorHostFailure    = "host_failure"
+)
+
 type Verdict string
 
 const (
-	VerdictUnjudged          Verdict = "unjudged"
-	VerdictAccepted          Verdict = "accepted"
-	VerdictWrongAnswer       Verdict = "wrong answer"
-	VerdictTimeLimitExceeded Verdict = "time limit exceeded"
-	VerdictRuntimeError      Verdict = "run-time error"
+	VerdictUnjudged            Verdict = "unjudged"
+	VerdictAccepted            Verdict = "accepted"
+	VerdictWrongAnswer         Verdict = "wrong answer"
+	VerdictTimeLimitExceeded   Verdict = "time limit exceeded"
+	VerdictRuntimeError        Verdict = "run-time error"
+	VerdictMemoryLimitExceeded Verdict = "memory limit exceeded"
+	VerdictOutputLimitExceeded Verdict = "output limit exceeded"
+	VerdictJudgeError          Verdict = "judge error"
 )
 
 type Submission struct {
@@ -158,14 +186,27 @@ type SubmissionRun struct {
 	DateCreated      time.Time      `gorm:"autoCreateTime"`
 	Status           string
 	Verdict          Verdict
+	SampleVerdict    Verdict
 	TimeUsageMs      int64
 	Score            float64
 	CompileError     string
+	JudgeError       string
+	JudgeErrorReason string
+	JudgeAttempts    int
+	AttemptId        string
+	LeaseOwner       sql.NullString
+	LeaseExpiry      sql.NullTime
 }
 
 func (j *JSON) Scan(value interface{}) error {
-	bytes, ok := value.([]byte)
-	if !ok {
+	var bytes []byte
+	switch v := value.(type) {
+	case []byte:
+		bytes = v
+	case string:
+		// SQLite returns JSON stored as text as a string.
+		bytes = []byte(v)
+	default:
 		return errors.New(fmt.Sprint("Failed to unmarshal JSONB value:", value))
 	}
 
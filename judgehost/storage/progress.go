@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ProgressChannel is the channel that run progress is published on.
+const ProgressChannel = "run_progress"
+
+// RunProgress is published whenever a run changes status or a test case of it has been judged.
+type RunProgress struct {
+	RunId  int64  `json:"run_id"`
+	Status string `json:"status"`
+	// TestcaseIndex is the index of the judged test case among the test cases of the run, in judging order.
+	TestcaseIndex     *int    `json:"testcase_index,omitempty"`
+	ProblemTestcaseId int64   `json:"problem_testcase_id,omitempty"`
+	Verdict           Verdict `json:"verdict,omitempty"`
+	// SampleVerdict is the verdict of the run on the samples, published once the samples have been prejudged.
+	SampleVerdict Verdict `json:"sample_verdict,omitempty"`
+}
+
+// NotifyProgress publishes the progress of runs to listeners of ProgressChannel.
+// Several updates are published in a single statement, in the order they are given.
+func (s *GormStore) NotifyProgress(progress ...RunProgress) error {
+	if len(progress) == 0 {
+		return nil
+	}
+	if s.db.Dialector.Name() != "postgres" {
+		// Only Postgres can notify listeners, so progress is not published elsewhere.
+		return nil
+	}
+	var notifies []string
+	var args []interface{}
+	for _, p := range progress {
+		payload, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		notifies = append(notifies, "pg_notify(?, ?)")
+		args = append(args, ProgressChannel, string(payload))
+	}
+	if res := s.db.Exec("SELECT "+strings.Join(notifies, ", "), args...); res.Error != nil {
+		return fmt.Errorf("failed notifying run progress: %v", res.Error)
+	}
+	return nil
+}
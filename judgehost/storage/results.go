@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// finishedRunFields are the fields of a run written when it is finished.
+var finishedRunFields = []string{"Status", "Verdict", "TimeUsageMs", "Score", "AttemptId"}
+
+// lockLeasedRun locks a run for the rest of the transaction, returning ErrLeaseLost unless the owner holds its lease.
+func lockLeasedRun(tx *gorm.DB, runId int64, leaseOwner string) error {
+	var runs []SubmissionRun
+	if res := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("submission_run_id").
+		Where("submission_run_id = ? AND lease_owner = ?", runId, leaseOwner).
+		Find(&runs); res.Error != nil {
+		return res.Error
+	}
+	if len(runs) == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// writeFeedback writes the feedback of test cases whose results were just written.
+func writeFeedback(tx *gorm.DB, caseRuns []SubmissionCaseRun) error {
+	var feedback []*SubmissionCaseFeedback
+	for _, caseRun := range caseRuns {
+		if caseRun.Feedback != nil {
+			caseRun.Feedback.SubmissionCaseRunId = caseRun.SubmissionCaseRunId
+			feedback = append(feedback, caseRun.Feedback)
+		}
+	}
+	if len(feedback) == 0 {
+		return nil
+	}
+	return tx.Create(feedback).Error
+}
+
+// WriteResults writes results of test cases and groups of a run, together with the feedback of the test cases, the lease owner still holds the lease on it.
+func (s *GormStore) WriteResults(runId int64, leaseOwner string, caseRuns []SubmissionCaseRun, groupRuns []SubmissionGroupRun) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := lockLeasedRun(tx, runId, leaseOwner); err != nil {
+			return err
+		}
+		if len(caseRuns) > 0 {
+			if res := tx.Omit("Feedback").Create(caseRuns); res.Error != nil {
+				return res.Error
+			}
+			if err := writeFeedback(tx, caseRuns); err != nil {
+				return err
+			}
+		}
+		if len(groupRuns) > 0 {
+			if res := tx.Create(groupRuns); res.Error != nil {
+				return res.Error
+			}
+		}
+		return nil
+	})
+}
+
+// FinishRun marks the run as done, keeping only the results written under its attempt id.
+func (s *GormStore) FinishRun(run *SubmissionRun, leaseOwner string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := lockLeasedRun(tx, run.SubmissionRunId, leaseOwner); err != nil {
+			return err
+		}
+		if err := deleteOtherAttempts(tx, run.SubmissionRunId, run.AttemptId); err != nil {
+			return err
+		}
+		run.Status = StatusDone
+		return tx.Select(finishedRunFields).Save(run).Error
+	})
+}
+
+// DiscardResults removes the results written under an attempt id of a run that was not finished.
+func (s *GormStore) DiscardResults(runId int64, attemptId string) error {
+	caseRuns := s.db.Model(&SubmissionCaseRun{}).Select("submission_case_run_id").
+		Where("submission_run_id = ? AND attempt_id = ?", runId, attemptId)
+	if res := s.db.Where("submission_case_run_id IN (?)", caseRuns).Delete(&SubmissionCaseFeedback{}); res.Error != nil {
+		return res.Error
+	}
+	if res := s.db.Where("submission_run_id = ? AND attempt_id = ?", runId, attemptId).Delete(&SubmissionCaseRun{}); res.Error != nil {
+		return res.Error
+	}
+	return s.db.Where("submission_run_id = ? AND attempt_id = ?", runId, attemptId).Delete(&SubmissionGroupRun{}).Error
+}
+
+// deleteOtherAttempts removes the results of a run that were not written under the given attempt id.
+func deleteOtherAttempts(tx *gorm.DB, runId int64, attemptId string) error {
+	caseRuns := tx.Model(&SubmissionCaseRun{}).Select("submission_case_run_id").
+		Where("submission_run_id = ? AND (attempt_id IS NULL OR attempt_id <> ?)", runId, attemptId)
+	if res := tx.Where("submission_case_run_id IN (?)", caseRuns).Delete(&SubmissionCaseFeedback{}); res.Error != nil {
+		return res.Error
+	}
+	if res := tx.Where("submission_run_id = ? AND (attempt_id IS NULL OR attempt_id <> ?)", runId, attemptId).
+		Delete(&SubmissionCaseRun{}); res.Error != nil {
+		return res.Error
+	}
+	return tx.Where("submission_run_id = ? AND (attempt_id IS NULL OR attempt_id <> ?)", runId, attemptId).
+		Delete(&SubmissionGroupRun{}).Error
+}
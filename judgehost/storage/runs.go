@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrLeaseLost is returned when results are written for a run whose lease the writer no longer holds.
+var ErrLeaseLost = errors.New("lost lease on run")
+
+// finishedStatuses are the statuses of runs that have been judged and must not be judged again.
+var finishedStatuses = []string{StatusDone, StatusCompileError, StatusCancelled, StatusJudgeError}
+
+// RecordFailedAttempt stores the number of failed judging attempts of a run and the error of the latest one.
+// Runs that already finished are left as they are, in which case false is returned.
+func (s *GormStore) RecordFailedAttempt(runId int64, attempts int, reason string) (bool, error) {
+	res := s.db.Model(&SubmissionRun{SubmissionRunId: runId}).
+		Where("status NOT IN ?", finishedStatuses).
+		Updates(map[string]interface{}{
+			"judge_attempts": attempts,
+			"judge_error":    reason,
+		})
+	return res.RowsAffected > 0, res.Error
+}
+
+// MarkJudgeError gives up on judging a run for the given reason, unless the run has already finished.
+func (s *GormStore) MarkJudgeError(runId int64, reason string) error {
+	return s.db.Model(&SubmissionRun{SubmissionRunId: runId}).
+		Where("status NOT IN ?", finishedStatuses).
+		Updates(map[string]interface{}{
+			"status":             StatusJudgeError,
+			"verdict":            VerdictJudgeError,
+			"judge_error_reason": reason,
+			"lease_owner":        nil,
+			"lease_expiry":       nil,
+		}).Error
+}
+
+// RequeueRun returns a run to the queue for another judging attempt, removing any partial results of earlier attempts.
+// Runs that already finished are left as they are, in which case false is returned.
+func (s *GormStore) RequeueRun(runId int64) (bool, error) {
+	requeued := false
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var run SubmissionRun
+		if res := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("status").First(&run, runId); res.Error != nil {
+			return res.Error
+		}
+		for _, status := range finishedStatuses {
+			if run.Status == status {
+				return nil
+			}
+		}
+		requeued = true
+		return requeueRuns(tx, []int64{runId})
+	})
+	return requeued, err
+}
+
+// CancelQueuedRun marks a run that no judgehost has claimed yet as cancelled. It returns false if the run is not queued.
+func (s *GormStore) CancelQueuedRun(runId int64) (bool, error) {
+	res := s.db.Model(&SubmissionRun{SubmissionRunId: runId}).
+		Where("status = ?", StatusQueued).
+		Update("status", StatusCancelled)
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected > 0, nil
+}
+
+func requeueRuns(tx *gorm.DB, runIds []int64) error {
+	if err := deleteResults(tx, runIds); err != nil {
+		return err
+	}
+	return tx.Model(&SubmissionRun{}).
+		Where("submission_run_id IN ?", runIds).
+		Updates(map[string]interface{}{
+			"status":       StatusQueued,
+			"lease_owner":  nil,
+			"lease_expiry": nil,
+		}).Error
+}
+
+func deleteResults(tx *gorm.DB, runIds []int64) error {
+	caseRuns := tx.Model(&SubmissionCaseRun{}).Select("submission_case_run_id").Where("submission_run_id IN ?", runIds)
+	if res := tx.Where("submission_case_run_id IN (?)", caseRuns).Delete(&SubmissionCaseFeedback{}); res.Error != nil {
+		return res.Error
+	}
+	if res := tx.Where("submission_run_id IN ?", runIds).Delete(&SubmissionCaseRun{}); res.Error != nil {
+		return res.Error
+	}
+	return tx.Where("submission_run_id IN ?", runIds).Delete(&SubmissionGroupRun{}).Error
+}
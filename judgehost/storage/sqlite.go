@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"strings"
+)
+
+// defaultSqliteOptions make connections wait for each other rather than fail when the database is busy, and let the
+// queue read the database while a judgehost writes results.
+const defaultSqliteOptions = "_busy_timeout=10000&_journal_mode=WAL"
+
+func openSqlite(dsn string) (*sql.DB, gorm.Dialector, error) {
+	if !strings.Contains(dsn, "?") {
+		dsn += "?" + defaultSqliteOptions
+	}
+	db, err := sql.Open(sqlite.DriverName, dsn)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed opening SQLite database: %v", err)
+	}
+	return db, &sqlite.Dialector{Conn: db}, nil
+}
+
+// migrateSqlite creates the tables of the judge in a SQLite database, with the same names and columns as the
+// frontend uses in Postgres.
+func migrateSqlite(db *gorm.DB) error {
+	if err := db.AutoMigrate(
+		&StoredFile{},
+		&Problem{},
+		&ProblemOutputValidator{},
+		&ProblemGrader{},
+		&ProblemVersion{},
+		&ProblemTestgroup{},
+		&ProblemTestcase{},
+		&Submission{},
+		&SubmissionRun{},
+		&SubmissionCaseRun{},
+		&SubmissionCaseFeedback{},
+		&SubmissionGroupRun{},
+	); err != nil {
+		return fmt.Errorf("failed creating SQLite tables: %v", err)
+	}
+	return nil
+}
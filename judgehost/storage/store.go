@@ -0,0 +1,55 @@
+package storage
+
+// Store is where the queue and the judgehosts keep runs, problems and results.
+type Store interface {
+	// QueuedRunIds returns the IDs of all queued runs in increasing order.
+	QueuedRunIds() ([]int64, error)
+	// LoadRun loads a run together with its submission and problem version, including the validator and grader.
+	LoadRun(runId int64) (*SubmissionRun, error)
+	LoadProblemVersion(problemVersionId int64) (*ProblemVersion, error)
+	// LoadTestgroups loads the test groups of a problem version and their test cases, ordered by ID.
+	LoadTestgroups(problemVersionId int64) ([]*ProblemTestgroup, error)
+	CountTestcases(problemVersionId int64) (int64, error)
+	LoadStoredFiles(fileHashes []string) ([]StoredFile, error)
+
+	// ClaimRun leases a queued run to the given owner and marks it as compiling.
+	// It returns false if the run was not queued, e.g. if someone else already claimed it.
+	ClaimRun(runId int64, owner string) (bool, error)
+	// RenewLease extends the owner's lease on a run.
+	// It returns false if the owner no longer holds the lease.
+	RenewLease(runId int64, owner string) (bool, error)
+	// ReleaseLease gives up the owner's lease on a run once it has been judged.
+	ReleaseLease(runId int64, owner string) error
+	// ReapExpiredLeases returns runs whose lease expired while being judged to the queue, removing any partial
+	// results. The IDs of the requeued runs are returned.
+	ReapExpiredLeases() ([]int64, error)
+
+	// UpdateRun writes the given fields of a run, if the lease owner still holds the lease on it.
+	// It returns false if the lease was lost.
+	UpdateRun(run *SubmissionRun, leaseOwner string, fields ...string) (bool, error)
+	// RecordFailedAttempt stores the number of failed judging attempts of a run and the error of the latest one.
+	// Runs that already finished are left as they are, in which case false is returned.
+	RecordFailedAttempt(runId int64, attempts int, reason string) (bool, error)
+	// MarkJudgeError gives up on judging a run for the given reason, unless the run has already finished.
+	MarkJudgeError(runId int64, reason string) error
+	// RequeueRun returns a run to the queue for another judging attempt, removing any partial results of earlier
+	// attempts. Runs that already finished are left as they are, in which case false is returned.
+	RequeueRun(runId int64) (bool, error)
+	// CancelQueuedRun marks a run that no judgehost has claimed yet as cancelled. It returns false if the run is not
+	// queued.
+	CancelQueuedRun(runId int64) (bool, error)
+	// WriteResults writes results of test cases and groups of a run, together with the feedback of the test cases, if
+	// the lease owner still holds the lease on it.
+	// The results are tagged with the attempt id of the judging attempt that wrote them. They are inserted without
+	// being split into batches, so callers bound how many are written at once.
+	// It returns ErrLeaseLost if the lease was lost.
+	WriteResults(runId int64, leaseOwner string, caseRuns []SubmissionCaseRun, groupRuns []SubmissionGroupRun) error
+	// FinishRun marks the run as done, keeping only the results written under its attempt id, so a finished run never
+	// has results of several attempts. It returns ErrLeaseLost if the lease was lost.
+	FinishRun(run *SubmissionRun, leaseOwner string) error
+	// DiscardResults removes the results written under an attempt id of a run that was not finished.
+	DiscardResults(runId int64, attemptId string) error
+
+	// NotifyProgress publishes the progress of runs to listeners of ProgressChannel, in the order they are given.
+	NotifyProgress(progress ...RunProgress) error
+}
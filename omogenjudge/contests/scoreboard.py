@@ -208,7 +208,7 @@ class Scoring(ScoreboardMaker):
             if status in [Status.RUNNING, Status.QUEUED, Status.COMPILING]:
                 problem_result.pending += 1
                 continue
-            if status in [Status.JUDGE_ERROR, Status.COMPILE_ERROR]:
+            if status in [Status.JUDGE_ERROR, Status.COMPILE_ERROR, Status.CANCELLED]:
                 continue
             assert status == Status.DONE
 
@@ -249,7 +249,7 @@ class BinaryWithPenalty(ScoreboardMaker):
             if status in [Status.RUNNING, Status.QUEUED, Status.COMPILING]:
                 problem_result.pending += 1
                 continue
-            if status in [Status.JUDGE_ERROR, Status.COMPILE_ERROR]:
+            if status in [Status.JUDGE_ERROR, Status.COMPILE_ERROR, Status.CANCELLED]:
                 continue
             assert status == Status.DONE
             if problem_result.accepted:
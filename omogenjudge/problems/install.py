@@ -72,6 +72,7 @@ def _add_group(parent: Optional[ProblemTestgroup], group: ToolsGroup, db_version
         parent=parent,
         problem_version=db_version,
         testgroup_name=group_name,
+        is_sample=group_name == 'data/sample',
         break_on_reject=group.config['on_reject'] == 'break',
         scoring_mode=scoring_mode,
         verdict_mode=verdict_mode,
@@ -160,15 +161,22 @@ def _add_grader(problem: ToolsProblem) -> Optional[ProblemGrader]:
     return db_grader
 
 
+def _reject_on_sample_failure(problem: ToolsProblem) -> bool:
+    # Our own problem.yaml key, since the problem format has no way to say that failing the samples is final.
+    return bool(problem.config.get().get('reject_on_sample_failure', False))
+
+
 def _add_version(problem: ToolsProblem, db_problem: Problem) -> ProblemVersion:
     limits = problem.config.get('limits')
     db_version = ProblemVersion(
         problem=db_problem,
         time_limit_ms=limits.get('time') * 1000,
         memory_limit_kb=limits.get('memory') * 1000,
+        output_limit_kb=limits.get('output') * 1000,
         scoring=problem.is_scoring,
         interactive=problem.is_interactive,
         included_files=_included_files(problem),
+        reject_on_sample_failure=_reject_on_sample_failure(problem),
     )
     db_version.prefetch_id()
     db_version.root_group = _add_testdata(problem, db_version)
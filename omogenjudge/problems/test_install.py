@@ -0,0 +1,29 @@
+from types import SimpleNamespace
+
+from django.test import SimpleTestCase
+
+from omogenjudge.problems.install import _reject_on_sample_failure
+
+
+class _Config:
+    def __init__(self, data):
+        self._data = data
+
+    def get(self, key=None):
+        if key:
+            return self._data[key]
+        return self._data
+
+
+def _problem(**config):
+    return SimpleNamespace(config=_Config(config))
+
+
+class RejectOnSampleFailureTest(SimpleTestCase):
+
+    def test_defaults_to_judging_all_data(self):
+        self.assertFalse(_reject_on_sample_failure(_problem(name='Problem')))
+
+    def test_read_from_problem_yaml(self):
+        self.assertTrue(_reject_on_sample_failure(_problem(reject_on_sample_failure=True)))
+        self.assertFalse(_reject_on_sample_failure(_problem(reject_on_sample_failure=False)))
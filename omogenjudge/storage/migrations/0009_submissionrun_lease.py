@@ -0,0 +1,24 @@
+# Generated by Django 4.1.6 on 2026-10-18 10:12
+
+from django.db import migrations, models
+import omogenjudge.util.django_fields
+
+
+class Migration(migrations.Migration):
+
+    dependencies = [
+        ('storage', '0008_contest_try_penalty'),
+    ]
+
+    operations = [
+        migrations.AddField(
+            model_name='submissionrun',
+            name='lease_owner',
+            field=omogenjudge.util.django_fields.TextField(blank=True, null=True),
+        ),
+        migrations.AddField(
+            model_name='submissionrun',
+            name='lease_expiry',
+            field=models.DateTimeField(blank=True, null=True),
+        ),
+    ]
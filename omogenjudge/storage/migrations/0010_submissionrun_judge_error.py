@@ -0,0 +1,19 @@
+# Generated by Django 4.1.6 on 2026-10-18 11:03
+
+from django.db import migrations
+import omogenjudge.util.django_fields
+
+
+class Migration(migrations.Migration):
+
+    dependencies = [
+        ('storage', '0009_submissionrun_lease'),
+    ]
+
+    operations = [
+        migrations.AddField(
+            model_name='submissionrun',
+            name='judge_error',
+            field=omogenjudge.util.django_fields.TextField(blank=True, null=True),
+        ),
+    ]
@@ -0,0 +1,18 @@
+# Generated by Django 4.1.6 on 2026-10-18 11:40
+
+from django.db import migrations, models
+
+
+class Migration(migrations.Migration):
+
+    dependencies = [
+        ('storage', '0010_submissionrun_judge_error'),
+    ]
+
+    operations = [
+        migrations.AddField(
+            model_name='submissionrun',
+            name='judge_attempts',
+            field=models.IntegerField(default=0),
+        ),
+    ]
@@ -0,0 +1,19 @@
+# Generated by Django 4.1.6 on 2026-10-18 13:20
+
+from django.db import migrations, models
+
+
+class Migration(migrations.Migration):
+
+    dependencies = [
+        ('storage', '0011_submissionrun_judge_attempts'),
+    ]
+
+    operations = [
+        migrations.AddField(
+            model_name='problemversion',
+            name='output_limit_kb',
+            field=models.IntegerField(default=8000),
+            preserve_default=False,
+        ),
+    ]
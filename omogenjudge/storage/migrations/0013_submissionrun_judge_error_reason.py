@@ -0,0 +1,20 @@
+# Generated by Django 4.1.6 on 2026-10-18 14:05
+
+from django.db import migrations
+import omogenjudge.storage.models.submissions
+import omogenjudge.util.django_fields
+
+
+class Migration(migrations.Migration):
+
+    dependencies = [
+        ('storage', '0012_problemversion_output_limit_kb'),
+    ]
+
+    operations = [
+        migrations.AddField(
+            model_name='submissionrun',
+            name='judge_error_reason',
+            field=omogenjudge.util.django_fields.EnumField(blank=True, enum_type=omogenjudge.storage.models.submissions.JudgeErrorReason, null=True),
+        ),
+    ]
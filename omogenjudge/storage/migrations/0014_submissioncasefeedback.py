@@ -0,0 +1,28 @@
+# Generated by Django 4.1.6 on 2026-10-18 15:10
+
+from django.db import migrations, models
+import django.db.models.deletion
+import omogenjudge.util.django_fields
+
+
+class Migration(migrations.Migration):
+
+    dependencies = [
+        ('storage', '0013_submissionrun_judge_error_reason'),
+    ]
+
+    operations = [
+        migrations.CreateModel(
+            name='SubmissionCaseFeedback',
+            fields=[
+                ('submission_case_run', models.OneToOneField(on_delete=django.db.models.deletion.CASCADE, primary_key=True, related_name='feedback', serialize=False, to='storage.submissioncaserun')),
+                ('judge_message', omogenjudge.util.django_fields.TextField(blank=True)),
+                ('team_message', omogenjudge.util.django_fields.TextField(blank=True)),
+                ('stderr', omogenjudge.util.django_fields.TextField(blank=True)),
+                ('first_mismatch', omogenjudge.util.django_fields.TextField(blank=True)),
+            ],
+            options={
+                'db_table': 'submission_case_feedback',
+            },
+        ),
+    ]
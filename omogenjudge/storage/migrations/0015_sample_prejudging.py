@@ -0,0 +1,25 @@
+# Generated by Django 4.1.6 on 2026-10-18 15:50
+
+from django.db import migrations, models
+import omogenjudge.storage.models.submissions
+import omogenjudge.util.django_fields
+
+
+class Migration(migrations.Migration):
+
+    dependencies = [
+        ('storage', '0014_submissioncasefeedback'),
+    ]
+
+    operations = [
+        migrations.AddField(
+            model_name='problemversion',
+            name='reject_on_sample_failure',
+            field=models.BooleanField(default=False),
+        ),
+        migrations.AddField(
+            model_name='submissionrun',
+            name='sample_verdict',
+            field=omogenjudge.util.django_fields.EnumField(blank=True, enum_type=omogenjudge.storage.models.submissions.Verdict, null=True),
+        ),
+    ]
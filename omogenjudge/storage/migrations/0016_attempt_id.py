@@ -0,0 +1,29 @@
+# Generated by Django 4.1.6 on 2026-10-18 16:30
+
+from django.db import migrations
+import omogenjudge.util.django_fields
+
+
+class Migration(migrations.Migration):
+
+    dependencies = [
+        ('storage', '0015_sample_prejudging'),
+    ]
+
+    operations = [
+        migrations.AddField(
+            model_name='submissioncaserun',
+            name='attempt_id',
+            field=omogenjudge.util.django_fields.TextField(blank=True, null=True),
+        ),
+        migrations.AddField(
+            model_name='submissiongrouprun',
+            name='attempt_id',
+            field=omogenjudge.util.django_fields.TextField(blank=True, null=True),
+        ),
+        migrations.AddField(
+            model_name='submissionrun',
+            name='attempt_id',
+            field=omogenjudge.util.django_fields.TextField(blank=True, null=True),
+        ),
+    ]
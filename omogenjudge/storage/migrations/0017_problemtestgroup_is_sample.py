@@ -0,0 +1,22 @@
+# Generated by Django 4.1.6 on 2026-10-18 18:40
+
+from django.db import migrations, models
+
+
+class Migration(migrations.Migration):
+
+    dependencies = [
+        ('storage', '0016_attempt_id'),
+    ]
+
+    operations = [
+        migrations.AddField(
+            model_name='problemtestgroup',
+            name='is_sample',
+            field=models.BooleanField(default=False),
+        ),
+        migrations.RunSQL(
+            "UPDATE problem_testgroup SET is_sample = true WHERE testgroup_name = 'data/sample'",
+            migrations.RunSQL.noop,
+        ),
+    ]
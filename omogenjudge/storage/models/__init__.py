@@ -9,7 +9,7 @@ from omogenjudge.storage.models.problems import ProblemTestgroup, ProblemTestcas
 from omogenjudge.storage.models.contests import ContestProblem, ContestGroupContest, Contest, ContestGroup, \
     ContestStaff, ScoringType
 from omogenjudge.storage.models.submissions import SubmissionGroupRun, Submission, SubmissionRun, SubmissionCaseRun, \
-    SubmissionFiles, Status, Verdict
+    SubmissionCaseFeedback, SubmissionFiles, Status, Verdict
 from omogenjudge.storage.models.teams import TeamMember, Team
 
 
@@ -82,6 +82,7 @@ admin.site.register(Submission)
 admin.site.register(SubmissionRun, SubmissionRunAdmin)
 admin.site.register(SubmissionGroupRun)
 admin.site.register(SubmissionCaseRun)
+admin.site.register(SubmissionCaseFeedback)
 admin.site.register(Problem, ProblemAdmin)
 admin.site.register(ProblemTestgroup, TestGroupAdmin)
 admin.site.register(ProblemVersion)
@@ -128,6 +128,8 @@ class ProblemTestgroup(models.Model):
     parent = models.ForeignKey('self', models.CASCADE, null=True, related_name='children')
     problem_version = models.ForeignKey('ProblemVersion', models.CASCADE, related_name='testgroups')
     testgroup_name = django_fields.TextField()
+    # Whether this is the group of sample test cases, which are shown in the problem statement.
+    is_sample = models.BooleanField(default=False)
 
     # Test group config
     min_score = models.FloatField(null=True)
@@ -168,6 +170,7 @@ class ProblemVersion(PrefetchIDMixin, models.Model):
     root_group = models.ForeignKey('ProblemTestgroup', models.RESTRICT, related_name='+')
     time_limit_ms = models.IntegerField()
     memory_limit_kb = models.IntegerField()
+    output_limit_kb = models.IntegerField()
     output_validator = models.ForeignKey(ProblemOutputValidator, models.RESTRICT, null=True)
     custom_grader = models.ForeignKey(ProblemGrader, models.RESTRICT, null=True)
     included_files = models.JSONField(
@@ -176,6 +179,8 @@ class ProblemVersion(PrefetchIDMixin, models.Model):
     )
     scoring = models.BooleanField()
     interactive = models.BooleanField()
+    # Whether submissions failing the samples are rejected without being judged on the other test data.
+    reject_on_sample_failure = models.BooleanField(default=False)
     score_maximization = models.BooleanField(null=True)
 
     class Meta:
@@ -43,6 +43,9 @@ class Verdict(enum.Enum):
     WA = 'wrong answer'
     TLE = 'time limit exceeded'
     RTE = 'run-time error'
+    MLE = 'memory limit exceeded'
+    OLE = 'output limit exceeded'
+    JE = 'judge error'
 
 
 class Status(enum.Enum):
@@ -51,9 +54,17 @@ class Status(enum.Enum):
     RUNNING = 'running'
     COMPILE_ERROR = 'compile error'
     JUDGE_ERROR = 'judging error'
+    CANCELLED = 'cancelled'
     DONE = 'done'
 
 
+class JudgeErrorReason(enum.Enum):
+    ABORTED = 'aborted'
+    EVALUATOR_ERROR = 'evaluator_error'
+    UNKNOWN_VERDICT = 'unknown_verdict'
+    HOST_FAILURE = 'host_failure'
+
+
 class SubmissionRun(models.Model):
     submission_run_id = models.AutoField(primary_key=True)
     submission = models.ForeignKey(Submission, models.CASCADE)
@@ -61,9 +72,19 @@ class SubmissionRun(models.Model):
     date_created = models.DateTimeField(auto_now_add=True)
     status = EnumField(enum_type=Status)
     verdict = EnumField(enum_type=Verdict)
+    # The verdict on the samples alone, if the run was prejudged on them.
+    sample_verdict = EnumField(enum_type=Verdict, null=True, blank=True)
     time_usage_ms = models.IntegerField(null=True, blank=True)
     score = models.FloatField(null=True, blank=True)
     compile_error = django_fields.TextField(null=True, blank=True)
+    judge_error = django_fields.TextField(null=True, blank=True)
+    judge_error_reason = EnumField(enum_type=JudgeErrorReason, null=True, blank=True)
+    judge_attempts = models.IntegerField(default=0)
+    # The judging attempt whose results are stored for the run.
+    attempt_id = django_fields.TextField(null=True, blank=True)
+    # The judgehost currently judging the run and until when it holds the run.
+    lease_owner = django_fields.TextField(null=True, blank=True)
+    lease_expiry = models.DateTimeField(null=True, blank=True)
 
     def get_status(self):
         return Status(self.status)
@@ -83,11 +104,25 @@ class SubmissionCaseRun(models.Model):
     time_usage_ms = models.IntegerField()
     score = models.FloatField()
     verdict = EnumField(enum_type=Verdict)
+    attempt_id = django_fields.TextField(null=True, blank=True)
 
     class Meta:
         db_table = 'submission_case_run'
 
 
+class SubmissionCaseFeedback(models.Model):
+    """Excerpts of what the program and the output validator said about a test case, for debugging verdicts."""
+    submission_case_run = models.OneToOneField(SubmissionCaseRun, models.CASCADE, primary_key=True,
+                                               related_name='feedback')
+    judge_message = django_fields.TextField(blank=True)
+    team_message = django_fields.TextField(blank=True)
+    stderr = django_fields.TextField(blank=True)
+    first_mismatch = django_fields.TextField(blank=True)
+
+    class Meta:
+        db_table = 'submission_case_feedback'
+
+
 class SubmissionGroupRun(models.Model):
     submission_group_run_id = models.AutoField(primary_key=True)
     submission_run = models.ForeignKey(SubmissionRun, models.CASCADE, related_name='group_runs')
@@ -96,6 +131,7 @@ class SubmissionGroupRun(models.Model):
     time_usage_ms = models.IntegerField()
     score = models.FloatField()
     verdict = EnumField(enum_type=Verdict)
+    attempt_id = django_fields.TextField(null=True, blank=True)
 
     class Meta:
         db_table = 'submission_group_run'